@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cacheTTL is how long retrieved documents are reused by later probes of the
+// same target with the same options. Zero disables caching.
+var cacheTTL time.Duration
+
+// cacheMaxEntries bounds how many documents the cache holds, as every
+// distinct target and options of probe requests adds one. Zero means no
+// limit.
+var cacheMaxEntries = 1000
+
+var (
+	cacheMu sync.Mutex
+	cache   = map[string]cacheEntry{}
+)
+
+type cacheEntry struct {
+	jsonData interface{}
+	resp     *http.Response
+	expires  time.Time
+}
+
+var cacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "json_exporter_cache_requests_total",
+	Help: "Total number of lookups of retrieved documents in the cache by result",
+}, []string{"result"})
+
+func init() {
+	cacheRequestsTotal.WithLabelValues("hit")
+	cacheRequestsTotal.WithLabelValues("miss")
+	prometheus.MustRegister(cacheRequestsTotal)
+}
+
+// cacheKey identifies the request made to target with opts. The timeout
+// does not change the document retrieved, so it is left out.
+func cacheKey(target string, opts probeOptions) string {
+	opts.Timeout = 0
+	opts.NoCache = false
+	return fmt.Sprintf("%s\x00%+v", target, opts)
+}
+
+// cachedProbeTarget is probeTarget, reusing the document retrieved by an
+// earlier successful probe within cacheTTL unless opts.NoCache is set.
+func cachedProbeTarget(ctx context.Context, target string, opts probeOptions) (interface{}, *http.Response, error) {
+	if cacheTTL <= 0 {
+		return probeTarget(ctx, target, opts)
+	}
+
+	key := cacheKey(target, opts)
+	if !opts.NoCache {
+		cacheMu.Lock()
+		entry, ok := cache[key]
+		if ok && time.Now().After(entry.expires) {
+			delete(cache, key)
+			ok = false
+		}
+		cacheMu.Unlock()
+		if ok {
+			cacheRequestsTotal.WithLabelValues("hit").Inc()
+			return entry.jsonData, entry.resp, nil
+		}
+		cacheRequestsTotal.WithLabelValues("miss").Inc()
+	}
+
+	jsonData, resp, err := probeTarget(ctx, target, opts)
+	if err == nil {
+		now := time.Now()
+		cacheMu.Lock()
+		evictCacheEntries(now)
+		cache[key] = cacheEntry{jsonData: jsonData, resp: resp, expires: now.Add(cacheTTL)}
+		cacheMu.Unlock()
+	}
+	return jsonData, resp, err
+}
+
+// evictCacheEntries removes the entries of the cache expired at now, and
+// those expiring first if it is still full. cacheMu must be held.
+func evictCacheEntries(now time.Time) {
+	for key, entry := range cache {
+		if now.After(entry.expires) {
+			delete(cache, key)
+		}
+	}
+	for cacheMaxEntries > 0 && len(cache) >= cacheMaxEntries {
+		var oldest string
+		for key, entry := range cache {
+			if oldest == "" || entry.expires.Before(cache[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(cache, oldest)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProbeHandlerCache(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	defer func(ttl time.Duration) { cacheTTL = ttl }(cacheTTL)
+	cacheTTL = time.Minute
+
+	hits := testutil.ToFloat64(cacheRequestsTotal.WithLabelValues("hit"))
+	misses := testutil.ToFloat64(cacheRequestsTotal.WithLabelValues("miss"))
+
+	testData := []struct {
+		name     string
+		query    string
+		requests int
+	}{
+		{name: "first probe", requests: 1},
+		{name: "cached", requests: 1},
+		{name: "other options", query: "&format=json", requests: 2},
+		{name: "cached with other timeout", query: "&timeout=3s", requests: 2},
+		{name: "bypassed", query: "&nocache=true", requests: 3},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL+tt.query, nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			if requests != tt.requests {
+				t.Errorf("Got: %d requests, expected: %d", requests, tt.requests)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, "x 1") {
+				t.Errorf("Got: %s, expected to contain: x 1", body)
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(cacheRequestsTotal.WithLabelValues("hit")) - hits; got != 2 {
+		t.Errorf("Got: %v hits, expected: 2", got)
+	}
+	if got := testutil.ToFloat64(cacheRequestsTotal.WithLabelValues("miss")) - misses; got != 2 {
+		t.Errorf("Got: %v misses, expected: 2", got)
+	}
+}
+
+func TestCachedProbeTargetExpires(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	defer func(ttl time.Duration) { cacheTTL = ttl }(cacheTTL)
+	cacheTTL = 50 * time.Millisecond
+
+	opts := probeOptions{FollowRedirects: true}
+	for i := 0; i < 2; i++ {
+		if _, _, err := cachedProbeTarget(context.Background(), server.URL, opts); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, _, err := cachedProbeTarget(context.Background(), server.URL, opts); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if requests != 2 {
+		t.Errorf("Got: %d requests, expected: 2", requests)
+	}
+}
+
+func TestCachedProbeTargetEvicts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	defer func(ttl time.Duration, max int) { cacheTTL, cacheMaxEntries = ttl, max }(cacheTTL, cacheMaxEntries)
+	defer func() { cache = map[string]cacheEntry{} }()
+	cache = map[string]cacheEntry{}
+	cacheTTL = time.Minute
+	cacheMaxEntries = 2
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		if _, _, err := cachedProbeTarget(context.Background(), server.URL+path, probeOptions{}); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if len(cache) != 2 {
+		t.Errorf("Got: %d entries, expected: 2", len(cache))
+	}
+	if _, ok := cache[cacheKey(server.URL+"/a", probeOptions{})]; ok {
+		t.Errorf("Got: entry of /a, expected it to be evicted first")
+	}
+
+	cache = map[string]cacheEntry{}
+	cacheTTL = 50 * time.Millisecond
+	cacheMaxEntries = 0
+	if _, _, err := cachedProbeTarget(context.Background(), server.URL+"/d", probeOptions{}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, _, err := cachedProbeTarget(context.Background(), server.URL+"/e", probeOptions{}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(cache) != 1 {
+		t.Errorf("Got: %d entries, expected only the unexpired one", len(cache))
+	}
+}
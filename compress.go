@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding lists the encodings decompress handles, sent to targets
+// whose probes set no Accept-Encoding header.
+const acceptEncoding = "gzip, deflate, zstd"
+
+// decompress returns a reader of the body of a response with the given
+// Content-Encoding, decompressing up to maxBytes. Its errors tell that the
+// body was not validly encoded.
+func decompress(body io.Reader, encoding string, maxBytes int64) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return ioutil.NopCloser(body), nil
+	}
+	reader, err := newDecoder(body, encoding, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return decompressReader{ReadCloser: reader, encoding: encoding}, nil
+}
+
+// decompressReader tells errors reading the decompressed body apart from
+// those of parsing it.
+type decompressReader struct {
+	io.ReadCloser
+	encoding string
+}
+
+func (r decompressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("decompressing %s response: %v", r.encoding, err)
+	}
+	return n, err
+}
+
+func newDecoder(body io.Reader, encoding string, maxBytes int64) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		// Deflate is meant to be wrapped in zlib, but some servers send
+		// raw deflate data, told apart by the zlib header checksum.
+		buffered := bufio.NewReader(body)
+		header, err := buffered.Peek(2)
+		if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	case "zstd":
+		// Bound the window, so that a hostile frame cannot make the decoder
+		// allocate much more than the body may hold.
+		limit := uint64(maxBytes) + 1
+		if limit < zstd.MinWindowSize {
+			limit = zstd.MinWindowSize
+		} else if limit > zstd.MaxWindowSize {
+			limit = zstd.MaxWindowSize
+		}
+		decoder, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(limit), zstd.WithDecoderMaxWindow(limit))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+}
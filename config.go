@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/shiroyagicorp/prometheus-json-exporter/pkg/jsonwalk"
+)
+
+// Config is the exporter configuration read from -config.file.
+type Config struct {
+	Modules map[string]Module `yaml:"modules"`
+	// ScrapeTargets are probed in the background rather than on request.
+	ScrapeTargets []ScrapeTarget `yaml:"scrape_targets"`
+}
+
+// Module bundles the settings for probing a kind of target. Probes select a
+// module with the module query parameter. Settings a module leaves out keep
+// the values of defaultModule, which are set by flags.
+type Module struct {
+	// Prefix is prepended to every metric name.
+	Prefix string `yaml:"prefix"`
+	// Root is the path of the subtree of the document to walk, its keys
+	// separated by dots or "::", e.g. data.metrics. Metric names are
+	// relative to it. Unused when Metrics are set.
+	Root string `yaml:"root"`
+	// Labels are added to every metric exported by the probe.
+	Labels map[string]string `yaml:"labels"`
+	// LabelPaths maps label names to JSONPath expressions selecting their
+	// value in the document, e.g. cluster: $.cluster.name. They are added
+	// to the metrics of the document, and are empty when nothing matches.
+	LabelPaths map[string]string `yaml:"label_paths"`
+	// AllowParamOverrides lets the method, body and content_type probe
+	// parameters override the request the module sends, and export_strings
+	// export the strings of the document, e.g. of a local file, and
+	// insecure skip verifying the target's certificate. These parameters
+	// are refused otherwise.
+	AllowParamOverrides bool `yaml:"allow_param_overrides"`
+	// RequiredParams lists the query parameters probes of the module must
+	// have, e.g. those its body template refers to. Probes missing any are
+	// refused with a 400.
+	RequiredParams []string         `yaml:"required_params"`
+	Probe          probeOptions     `yaml:",inline"`
+	Walk           jsonwalk.Options `yaml:",inline"`
+	// Metrics select the values to export with JSONPath. When set, they
+	// replace walking the whole document.
+	Metrics []MetricConfig `yaml:"metrics"`
+}
+
+// MetricConfig defines a metric whose values are selected from the document
+// with a JSONPath expression.
+type MetricConfig struct {
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	// Path selects the values of the metric. A selected array of numbers
+	// exports one series per element, labeled with its index.
+	Path string `yaml:"path"`
+	// Labels maps label names to JSONPath expressions. The wildcards of a
+	// label's expression take the keys or indices matched by the wildcards
+	// of Path, so that labels come from the siblings of each value.
+	Labels map[string]string `yaml:"labels"`
+}
+
+func (m MetricConfig) validate() error {
+	if !model.IsValidMetricName(model.LabelValue(m.Name)) {
+		return fmt.Errorf("invalid metric name %q", m.Name)
+	}
+	if _, err := parseJSONPath(m.Path); err != nil {
+		return err
+	}
+	for name, expr := range m.Labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") || name == "index" {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if _, err := parseJSONPath(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	// defaultModule is used by probes that do not select a module.
+	defaultModule Module
+	// config holds the modules loaded from -config.file. It is replaced
+	// by reloadConfig, so read it with currentConfig.
+	config   = &Config{}
+	configMu sync.RWMutex
+)
+
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "json_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful",
+	})
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "json_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configReloadSuccess, configReloadSeconds)
+}
+
+func currentConfig() *Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+// reloadConfig loads the config file at path and replaces the current
+// configuration with it. When the file cannot be loaded, the current
+// configuration is kept.
+func reloadConfig(path string, logger log.Logger) error {
+	c, err := loadConfig(path)
+	if err != nil {
+		configReloadSuccess.Set(0)
+		level.Error(logger).Log("msg", "Error loading config file", "file", path, "err", err)
+		return err
+	}
+	configMu.Lock()
+	config = c
+	configMu.Unlock()
+	scrapes.update(c.ScrapeTargets, logger)
+	configReloadSuccess.Set(1)
+	configReloadSeconds.Set(float64(time.Now().Unix()))
+	level.Info(logger).Log("msg", "Loaded config file", "file", path, "modules", len(c.Modules))
+	return nil
+}
+
+func (m *Module) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*m = defaultModule
+	type plain Module
+	return unmarshal((*plain)(m))
+}
+
+func (m Module) validate() error {
+	if m.Probe.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if m.Probe.MaxBodyBytes < 0 {
+		return fmt.Errorf("max_body_bytes must not be negative")
+	}
+	if m.Probe.MaxRedirects < 0 {
+		return fmt.Errorf("max_redirects must not be negative")
+	}
+	if m.Probe.MaxRetries < 0 {
+		return fmt.Errorf("max_retries must not be negative")
+	}
+	if m.Probe.RetryBaseDelay < 0 {
+		return fmt.Errorf("retry_base_delay must not be negative")
+	}
+	switch m.Probe.Format {
+	case "", "json", "xml", "ndjson":
+	default:
+		return fmt.Errorf("invalid format %q, expected json, xml or ndjson", m.Probe.Format)
+	}
+	if m.Probe.ForwardAuthorization && webConfigured {
+		return fmt.Errorf("forward_authorization cannot be set along with -web.config.file")
+	}
+	if m.Probe.Password != "" && m.Probe.PasswordFile != "" {
+		return fmt.Errorf("at most one of password and password_file must be set")
+	}
+	if m.Probe.BearerToken != "" && m.Probe.BearerTokenFile != "" {
+		return fmt.Errorf("at most one of bearer_token and bearer_token_file must be set")
+	}
+	if m.Probe.Exec != nil {
+		if err := m.Probe.Exec.validate(); err != nil {
+			return fmt.Errorf("exec: %v", err)
+		}
+	}
+	if m.Probe.OAuth2 != nil {
+		if err := m.Probe.OAuth2.validate(); err != nil {
+			return fmt.Errorf("oauth2: %v", err)
+		}
+		if m.Probe.Username != "" || m.Probe.BearerToken != "" || m.Probe.BearerTokenFile != "" {
+			return fmt.Errorf("oauth2 cannot be combined with username or bearer_token")
+		}
+	}
+	for _, name := range m.RequiredParams {
+		if name == "" {
+			return fmt.Errorf("required_params: empty parameter name")
+		}
+	}
+	if _, err := parseBody(m.Probe.Body); err != nil {
+		return fmt.Errorf("invalid body template: %v", err)
+	}
+	if m.Walk.Namespace != "" && !model.IsValidMetricName(model.LabelValue(m.Walk.Namespace)) {
+		return fmt.Errorf("invalid namespace %q", m.Walk.Namespace)
+	}
+	if m.Walk.Subsystem != "" && !model.IsValidMetricName(model.LabelValue(m.Walk.Subsystem)) {
+		return fmt.Errorf("invalid subsystem %q", m.Walk.Subsystem)
+	}
+	if m.Walk.MaxDepth < 0 {
+		return fmt.Errorf("max_depth must not be negative")
+	}
+	if m.Walk.FlattenDepth < 0 {
+		return fmt.Errorf("flatten_depth must not be negative")
+	}
+	if m.Walk.MaxArrayLength < 0 {
+		return fmt.Errorf("max_array_length must not be negative")
+	}
+	for _, rule := range m.Walk.MetricTypes {
+		if rule.Path.Regexp == nil {
+			return fmt.Errorf("metric_types: missing path")
+		}
+		if rule.Type != "gauge" && rule.Type != "counter" && rule.Type != "untyped" && rule.Type != "histogram" {
+			return fmt.Errorf("metric_types: invalid type %q", rule.Type)
+		}
+		if len(rule.Buckets) > 0 && rule.Type != "histogram" {
+			return fmt.Errorf("metric_types: buckets are only allowed for histograms")
+		}
+		for i := 1; i < len(rule.Buckets); i++ {
+			if rule.Buckets[i] <= rule.Buckets[i-1] {
+				return fmt.Errorf("metric_types: buckets must be in increasing order")
+			}
+		}
+	}
+	for _, rule := range m.Walk.Aggregate {
+		if rule.Path.Regexp == nil {
+			return fmt.Errorf("aggregate: missing path")
+		}
+		for _, function := range rule.Functions {
+			if !isAggregateFunction(function) {
+				return fmt.Errorf("aggregate: invalid function %q", function)
+			}
+		}
+	}
+	for _, rule := range m.Walk.ValueMaps {
+		if rule.Path.Regexp == nil {
+			return fmt.Errorf("value_maps: missing path")
+		}
+	}
+	for _, rule := range m.Walk.Scale {
+		if rule.Path.Regexp == nil {
+			return fmt.Errorf("scale: missing path")
+		}
+	}
+	for _, rule := range m.Walk.Help {
+		if rule.Path.Regexp == nil {
+			return fmt.Errorf("help: missing path")
+		}
+		if rule.Unit != "" && !model.LabelName(rule.Unit).IsValid() {
+			return fmt.Errorf("help: invalid unit %q", rule.Unit)
+		}
+	}
+	for _, rule := range m.Walk.ObjectArrays {
+		if rule.Path.Regexp == nil {
+			return fmt.Errorf("object_arrays: missing path")
+		}
+		if len(rule.Labels) == 0 {
+			return fmt.Errorf("object_arrays: missing labels")
+		}
+	}
+	for _, rule := range m.Walk.Rename {
+		if rule.Path.Regexp == nil {
+			return fmt.Errorf("rename: missing path")
+		}
+		if rule.Name == "" {
+			return fmt.Errorf("rename: missing name")
+		}
+		for name := range rule.Labels {
+			if !model.LabelName(name).IsValid() {
+				return fmt.Errorf("rename: invalid label name %q", name)
+			}
+		}
+	}
+	if m.Probe.ProxyURL != "" {
+		if _, err := parseProxyURL(m.Probe.ProxyURL); err != nil {
+			return err
+		}
+	}
+	if _, err := m.Probe.TLS.tlsConfig(); err != nil {
+		return fmt.Errorf("invalid tls_config: %v", err)
+	}
+	for _, metric := range m.Metrics {
+		if err := metric.validate(); err != nil {
+			return fmt.Errorf("metric %q: %v", metric.Name, err)
+		}
+	}
+	return m.checkLabels()
+}
+
+// checkLabels makes sure the static labels are valid and cannot clash with
+// the labels the walk adds.
+func (m Module) checkLabels() error {
+	names := make([]string, 0, len(m.Labels)+len(m.LabelPaths))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	for name, expr := range m.LabelPaths {
+		if _, ok := m.Labels[name]; ok {
+			return fmt.Errorf("label %q is set by both labels and label_paths", name)
+		}
+		if _, err := parseJSONPath(expr); err != nil {
+			return fmt.Errorf("label_paths: %v", err)
+		}
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if arrayIndexLabel.MatchString(name) {
+			return fmt.Errorf("label %q clashes with array index labels", name)
+		}
+		if reservedLabels[name] {
+			return fmt.Errorf("label %q clashes with the labels of probe metrics", name)
+		}
+		for _, key := range m.Walk.LabelKeys {
+			if name == jsonwalk.SanitizeLabelName(key) {
+				return fmt.Errorf("label %q clashes with label key %q", name, key)
+			}
+		}
+	}
+	return nil
+}
+
+// arrayIndexLabel matches the array index labels the walk adds, prefixed by
+// the array's path with PathIndexLabels.
+var arrayIndexLabel = regexp.MustCompile(`(^|_)array_[0-9]+_index$`)
+
+// webConfigured is set when -web.config.file is, which may protect the
+// exporter with basic auth whose credentials must not reach targets.
+var webConfigured bool
+
+// reservedLabels are the labels of the probe's own metrics, such as the
+// phase of probe_http_duration_seconds, which a static label of the same
+// name would clash with.
+var reservedLabels = map[string]bool{"phase": true, "reason": true, "type": true, "url": true}
+
+// loadConfig reads and validates the configuration in path.
+func loadConfig(path string) (*Config, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(bytes, c); err != nil {
+		return nil, err
+	}
+	for name, module := range c.Modules {
+		if err := module.expandSecrets(); err != nil {
+			return nil, fmt.Errorf("module %q: %v", name, err)
+		}
+		if err := module.validate(); err != nil {
+			return nil, fmt.Errorf("module %q: %v", name, err)
+		}
+		c.Modules[name] = module
+	}
+	for i, target := range c.ScrapeTargets {
+		if err := target.validate(c.Modules); err != nil {
+			return nil, fmt.Errorf("scrape target %d: %v", i+1, err)
+		}
+	}
+	return c, nil
+}
+
+// envReference matches the ${NAME} references to environment variables
+// expanded by expandEnv. Unlike os.ExpandEnv, $NAME is left alone, as
+// secrets may well contain dollar signs.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${NAME} references in s with the value of the
+// environment variables they name. Unset variables are errors, rather than
+// sending empty credentials.
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(s, func(reference string) string {
+		name := envReference.FindStringSubmatch(reference)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// expandSecrets expands the environment variable references in the
+// credentials of the module and the values of its headers, so that they
+// need not be written in the config file.
+func (m *Module) expandSecrets() error {
+	fields := map[string]*string{
+		"username":     &m.Probe.Username,
+		"password":     &m.Probe.Password,
+		"bearer_token": &m.Probe.BearerToken,
+	}
+	if m.Probe.OAuth2 != nil {
+		oauth2 := *m.Probe.OAuth2
+		m.Probe.OAuth2 = &oauth2
+		fields["oauth2: client_id"] = &oauth2.ClientID
+		fields["oauth2: client_secret"] = &oauth2.ClientSecret
+	}
+	for name, field := range fields {
+		value, err := expandEnv(*field)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		*field = value
+	}
+
+	// The headers may be those of defaultModule, so expand a copy.
+	headers := make(map[string]headerValues, len(m.Probe.Headers))
+	for name, values := range m.Probe.Headers {
+		expanded := make(headerValues, len(values))
+		for i, value := range values {
+			var err error
+			if expanded[i], err = expandEnv(value); err != nil {
+				return fmt.Errorf("header %s: %v", name, err)
+			}
+		}
+		headers[name] = expanded
+	}
+	if m.Probe.Headers != nil {
+		m.Probe.Headers = headers
+	}
+	return nil
+}
+
+func isAggregateFunction(function string) bool {
+	for _, f := range jsonwalk.AggregateFunctions {
+		if f == function {
+			return true
+		}
+	}
+	return false
+}
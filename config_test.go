@@ -0,0 +1,781 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/shiroyagicorp/prometheus-json-exporter/pkg/jsonwalk"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	defer func(m Module) { defaultModule = m }(defaultModule)
+	defaultModule = Module{Walk: jsonwalk.Options{Separator: "::", ParseNumericStrings: true}}
+
+	path := writeConfig(t, `
+modules:
+  billing:
+    prefix: billing
+    timeout: 5s
+    bearer_token: secret
+    name_separator: _
+    label_keys: [name, id]
+    headers:
+      Accept: application/json
+      X-Tenant: [a, b]
+    tls_config:
+      insecure_skip_verify: true
+`)
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	expected := Module{
+		Prefix: "billing",
+		Probe: probeOptions{
+			BearerToken: "secret",
+			Timeout:     5 * time.Second,
+			TLS:         TLSConfig{InsecureSkipVerify: true},
+			Headers: map[string]headerValues{
+				"Accept":   {"application/json"},
+				"X-Tenant": {"a", "b"},
+			},
+		},
+		Walk: jsonwalk.Options{
+			ParseNumericStrings: true,
+			Separator:           "_",
+			LabelKeys:           []string{"name", "id"},
+		},
+	}
+	if actual := c.Modules["billing"]; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got: %+v, expected: %+v", actual, expected)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	os.Setenv("JSON_EXPORTER_TEST_PASSWORD", "pa$$word")
+	defer os.Unsetenv("JSON_EXPORTER_TEST_PASSWORD")
+	os.Setenv("JSON_EXPORTER_TEST_TENANT", "acme")
+	defer os.Unsetenv("JSON_EXPORTER_TEST_TENANT")
+
+	path := writeConfig(t, `
+modules:
+  billing:
+    username: user
+    password: ${JSON_EXPORTER_TEST_PASSWORD}
+    headers:
+      X-Tenant: tenant-${JSON_EXPORTER_TEST_TENANT}
+      X-Price: $5
+`)
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	probe := c.Modules["billing"].Probe
+	if probe.Password != "pa$$word" {
+		t.Errorf("Got: %v, expected: %v", probe.Password, "pa$$word")
+	}
+	expected := map[string]headerValues{"X-Tenant": {"tenant-acme"}, "X-Price": {"$5"}}
+	if !reflect.DeepEqual(probe.Headers, expected) {
+		t.Errorf("Got: %v, expected: %v", probe.Headers, expected)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+	config = &Config{}
+
+	path := writeConfig(t, `
+modules:
+  billing:
+    prefix: billing
+`)
+	if err := reloadConfig(path, log.NewNopLogger()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if actual := currentConfig().Modules["billing"].Prefix; actual != "billing" {
+		t.Errorf("Got prefix: %v, expected: billing", actual)
+	}
+	if actual := testutil.ToFloat64(configReloadSuccess); actual != 1 {
+		t.Errorf("Got: %v, expected: 1", actual)
+	}
+
+	// An invalid file keeps the current configuration.
+	if err := ioutil.WriteFile(path, []byte("modules:\n  billing:\n    timeout: -1s\n"), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := reloadConfig(path, log.NewNopLogger()); err == nil {
+		t.Errorf("Got: nil, expected an error")
+	}
+	if actual := currentConfig().Modules["billing"].Prefix; actual != "billing" {
+		t.Errorf("Got prefix: %v, expected: billing", actual)
+	}
+	if actual := testutil.ToFloat64(configReloadSuccess); actual != 0 {
+		t.Errorf("Got: %v, expected: 0", actual)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	testData := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			name: "unknown field",
+			content: `
+modules:
+  billing:
+    prefixx: billing
+`,
+			err: "field prefixx not found",
+		},
+		{
+			name: "missing CA file",
+			content: `
+modules:
+  billing:
+    tls_config:
+      ca_file: /nonexistent/ca.pem
+`,
+			err: `module "billing": invalid tls_config`,
+		},
+		{
+			name: "label path clashing with probe metrics",
+			content: `
+modules:
+  billing:
+    label_paths:
+      phase: $.phase
+`,
+			err: `module "billing": label "phase" clashes with the labels of probe metrics`,
+		},
+		{
+			name: "empty required parameter",
+			content: `
+modules:
+  billing:
+    required_params: [region, ""]
+`,
+			err: `module "billing": required_params: empty parameter name`,
+		},
+		{
+			name: "forward_authorization with web config",
+			content: `
+modules:
+  billing:
+    forward_authorization: true
+`,
+			err: `module "billing": forward_authorization cannot be set along with -web.config.file`,
+		},
+		{
+			name: "rename without name",
+			content: `
+modules:
+  billing:
+    rename:
+    - path: ^nodes::array_0::cpu$
+`,
+			err: `module "billing": rename: missing name`,
+		},
+		{
+			name: "token and token file",
+			content: `
+modules:
+  billing:
+    bearer_token: secret
+    bearer_token_file: /var/run/secrets/token
+`,
+			err: `module "billing": at most one of bearer_token and bearer_token_file must be set`,
+		},
+		{
+			name: "scrape target with unknown module",
+			content: `
+scrape_targets:
+- target: http://app:8080/stats
+  module: app
+`,
+			err: `scrape target 1: unknown module "app"`,
+		},
+		{
+			name: "scrape target module labeled with target",
+			content: `
+modules:
+  app:
+    labels:
+      target: app
+scrape_targets:
+- target: http://app:8080/stats
+  module: app
+`,
+			err: `scrape target 1: label "target" of module "app" clashes with the label of scrape targets`,
+		},
+		{
+			name: "unset environment variable",
+			content: `
+modules:
+  billing:
+    bearer_token: ${JSON_EXPORTER_TEST_UNSET}
+`,
+			err: `module "billing": bearer_token: environment variable JSON_EXPORTER_TEST_UNSET is not set`,
+		},
+		{
+			name: "exec without command",
+			content: `
+modules:
+  ceph:
+    exec:
+      env: {CEPH_CONF: /etc/ceph/ceph.conf}
+`,
+			err: `module "ceph": exec: missing command`,
+		},
+		{
+			name: "oauth2 without client_id",
+			content: `
+modules:
+  billing:
+    oauth2:
+      token_url: https://auth.example.com/token
+`,
+			err: `module "billing": oauth2: missing client_id`,
+		},
+		{
+			name: "negative flatten_depth",
+			content: `
+modules:
+  billing:
+    flatten_depth: -1
+`,
+			err: `module "billing": flatten_depth must not be negative`,
+		},
+		{
+			name: "negative max_redirects",
+			content: `
+modules:
+  billing:
+    max_redirects: -1
+`,
+			err: `module "billing": max_redirects must not be negative`,
+		},
+		{
+			name: "invalid aggregate function",
+			content: `
+modules:
+  billing:
+    aggregate:
+    - path: ^latencies$
+      functions: [median]
+`,
+			err: `module "billing": aggregate: invalid function "median"`,
+		},
+		{
+			name: "value map without path",
+			content: `
+modules:
+  billing:
+    value_maps:
+    - values: {green: 0}
+`,
+			err: `module "billing": value_maps: missing path`,
+		},
+		{
+			name: "invalid namespace",
+			content: `
+modules:
+  billing:
+    namespace: my-app
+`,
+			err: `module "billing": invalid namespace "my-app"`,
+		},
+		{
+			name: "invalid body template",
+			content: `
+modules:
+  billing:
+    body: '{"index": "{{ .index"}'
+`,
+			err: `module "billing": invalid body template: template: body:1: bad character U+0022 '"'`,
+		},
+		{
+			name: "label in labels and label_paths",
+			content: `
+modules:
+  billing:
+    labels:
+      cluster: prod
+    label_paths:
+      cluster: $.cluster
+`,
+			err: `module "billing": label "cluster" is set by both labels and label_paths`,
+		},
+		{
+			name: "invalid label path",
+			content: `
+modules:
+  billing:
+    label_paths:
+      cluster: cluster.name
+`,
+			err: `module "billing": label_paths: invalid JSONPath "cluster.name": must start with $`,
+		},
+		{
+			name: "cert without key",
+			content: `
+modules:
+  billing:
+    tls_config:
+      cert_file: /etc/ssl/client.pem
+`,
+			err: `module "billing": invalid tls_config: cert_file and key_file must be set together`,
+		},
+		{
+			name: "invalid min_version",
+			content: `
+modules:
+  billing:
+    tls_config:
+      min_version: TLS1.2
+`,
+			err: `module "billing": invalid tls_config: invalid min_version "TLS1.2"`,
+		},
+		{
+			name: "invalid proxy_url",
+			content: `
+modules:
+  billing:
+    proxy_url: ftp://proxy:21
+`,
+			err: `invalid proxy URL "ftp://proxy:21"`,
+		},
+		{
+			name: "invalid include_path",
+			content: `
+modules:
+  billing:
+    include_path: "count("
+`,
+			err: "error parsing regexp",
+		},
+		{
+			name: "invalid metric type",
+			content: `
+modules:
+  billing:
+    metric_types:
+    - path: _total$
+      type: summary
+`,
+			err: `metric_types: invalid type "summary"`,
+		},
+		{
+			name: "unordered histogram buckets",
+			content: `
+modules:
+  billing:
+    metric_types:
+    - path: ^latencies$
+      type: histogram
+      buckets: [1, 0.5]
+`,
+			err: `metric_types: buckets must be in increasing order`,
+		},
+		{
+			name: "invalid metric path",
+			content: `
+modules:
+  billing:
+    metrics:
+    - name: billing_total
+      path: $..total
+`,
+			err: `metric "billing_total": invalid JSONPath "$..total"`,
+		},
+		{
+			name: "invalid metric name",
+			content: `
+modules:
+  billing:
+    metrics:
+    - name: billing-total
+      path: $.total
+`,
+			err: `invalid metric name "billing-total"`,
+		},
+	}
+
+	defer func(configured bool) { webConfigured = configured }(webConfigured)
+	webConfigured = true
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Got: %v, expected error containing: %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerModule(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{Modules: map[string]Module{
+		"billing":  {Prefix: "billing"},
+		"regional": {RequiredParams: []string{"region", "account"}},
+	}}
+
+	testData := []struct {
+		name     string
+		query    string
+		status   int
+		expected string
+	}{
+		{
+			name:     "module prefix",
+			query:    "&module=billing",
+			status:   http.StatusOK,
+			expected: "billing::x 1\n",
+		},
+		{
+			name:     "query parameter overrides module",
+			query:    "&module=billing&prefix=other",
+			status:   http.StatusOK,
+			expected: "other::x 1\n",
+		},
+		{
+			name:     "missing required parameters",
+			query:    "&module=regional&account=",
+			status:   http.StatusBadRequest,
+			expected: "Missing required parameters: region, account",
+		},
+		{
+			name:     "required parameters",
+			query:    "&module=regional&region=eu&account=42",
+			status:   http.StatusOK,
+			expected: "x 1\n",
+		},
+		{
+			name:     "unknown module",
+			query:    "&module=nope",
+			status:   http.StatusOK,
+			expected: `probe_success{reason="unknown_module"} 0`,
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL+tt.query, nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			if rec.Code != tt.status {
+				t.Errorf("Got status: %d, expected: %d", rec.Code, tt.status)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tt.expected) {
+				t.Errorf("Got: %s, expected to contain: %s", body, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerLabels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": [1]}`))
+	}))
+	defer server.Close()
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{Modules: map[string]Module{
+		"billing": {Labels: map[string]string{"service": "billing", "env": "staging"}},
+	}}
+
+	testData := []struct {
+		name     string
+		query    string
+		status   int
+		expected []string
+	}{
+		{
+			name:     "module labels",
+			query:    "&module=billing",
+			status:   http.StatusOK,
+			expected: []string{`x::array_0{array_0_index="0",env="staging",service="billing"} 1`, `probe_success{env="staging",service="billing"} 1`},
+		},
+		{
+			name:     "label parameters override module labels",
+			query:    "&module=billing&label=env:prod&label=team:payments",
+			status:   http.StatusOK,
+			expected: []string{`x::array_0{array_0_index="0",env="prod",service="billing",team="payments"} 1`},
+		},
+		{
+			name:     "malformed label parameter",
+			query:    "&label=env",
+			status:   http.StatusBadRequest,
+			expected: []string{`invalid label parameter "env"`},
+		},
+		{
+			name:     "label clashing with array index",
+			query:    "&label=array_0_index:1",
+			status:   http.StatusBadRequest,
+			expected: []string{`label "array_0_index" clashes with array index labels`},
+		},
+		{
+			name:     "label clashing with probe metrics",
+			query:    "&label=type:x",
+			status:   http.StatusBadRequest,
+			expected: []string{`label "type" clashes with the labels of probe metrics`},
+		},
+		{
+			name:     "label clashing with label key",
+			query:    "&label=name:x&label_keys=name",
+			status:   http.StatusBadRequest,
+			expected: []string{`label "name" clashes with label key "name"`},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL+tt.query, nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			if rec.Code != tt.status {
+				t.Errorf("Got status: %d, expected: %d", rec.Code, tt.status)
+			}
+			body := rec.Body.String()
+			for _, expected := range tt.expected {
+				if !strings.Contains(body, expected) {
+					t.Errorf("Got: %s, expected to contain: %s", body, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeHandlerMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"total": 3, "queues": {"a": {"name": "alpha", "size": 1, "history": [4, 5]}, "b": {"name": "beta", "size": 2}}}`))
+	}))
+	defer server.Close()
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{Modules: map[string]Module{
+		"queues": {Metrics: []MetricConfig{
+			{Name: "queue_total", Help: "Total messages", Path: "$.total"},
+			{Name: "queue_size", Path: "$.queues.*.size", Labels: map[string]string{"queue": "$.queues.*.name"}},
+			{Name: "queue_history", Path: "$.queues.*.history", Labels: map[string]string{"queue": "$.queues.*.name"}},
+		}},
+	}}
+
+	req := httptest.NewRequest("GET", "/probe?module=queues&target="+server.URL, nil)
+	rec := httptest.NewRecorder()
+	probeHandler(rec, req, log.NewNopLogger())
+
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"# HELP queue_total Total messages",
+		"queue_total 3",
+		`queue_size{queue="alpha"} 1`,
+		`queue_size{queue="beta"} 2`,
+		`queue_history{index="0",queue="alpha"} 4`,
+		`queue_history{index="1",queue="alpha"} 5`,
+		"probe_success 1",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Got: %s, expected to contain: %s", body, expected)
+		}
+	}
+	if strings.Contains(body, "total::") || strings.Contains(body, "probe_max_depth") {
+		t.Errorf("Got: %s, expected only selected metrics", body)
+	}
+}
+
+func TestProbeHandlerLabelPaths(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"cluster": {"name": "east", "nodes": 3}, "version": 2}`))
+	}))
+	defer server.Close()
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{Modules: map[string]Module{
+		"cluster": {
+			Labels:     map[string]string{"env": "prod"},
+			LabelPaths: map[string]string{"cluster": "$.cluster.name", "region": "$.region"},
+		},
+	}}
+
+	req := httptest.NewRequest("GET", "/probe?module=cluster&target="+server.URL, nil)
+	rec := httptest.NewRecorder()
+	probeHandler(rec, req, log.NewNopLogger())
+
+	body := rec.Body.String()
+	for _, expected := range []string{
+		`cluster::nodes{cluster="east",env="prod",region=""} 3`,
+		`version{cluster="east",env="prod",region=""} 2`,
+		`probe_success{env="prod"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Got: %s, expected to contain: %s", body, expected)
+		}
+	}
+}
+
+func TestProbeHandlerJSONPathParams(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"total": 3, "history": [1, 2]}`))
+	}))
+	defer server.Close()
+
+	testData := []struct {
+		name       string
+		query      string
+		status     int
+		expected   []string
+		unexpected []string
+	}{
+		{
+			name:       "selected values",
+			query:      "&jsonpath=queue_total:$.total&jsonpath=queue_history:$.history",
+			status:     http.StatusOK,
+			expected:   []string{"queue_total 3", `queue_history{index="0"} 1`, `queue_history{index="1"} 2`},
+			unexpected: []string{"total::", "probe_max_depth"},
+		},
+		{
+			name:     "missing name",
+			query:    "&jsonpath=$.total",
+			status:   http.StatusBadRequest,
+			expected: []string{`invalid jsonpath parameter "$.total": expected name:expression`},
+		},
+		{
+			name:     "invalid expression",
+			query:    "&jsonpath=queue_total:total",
+			status:   http.StatusBadRequest,
+			expected: []string{`invalid jsonpath parameter "queue_total:total": invalid JSONPath "total": must start with $`},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL+strings.ReplaceAll(tt.query, "$", "%24"), nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			if rec.Code != tt.status {
+				t.Errorf("Got status: %d, expected: %d", rec.Code, tt.status)
+			}
+			body := rec.Body.String()
+			for _, expected := range tt.expected {
+				if !strings.Contains(body, expected) {
+					t.Errorf("Got: %s, expected to contain: %s", body, expected)
+				}
+			}
+			for _, unexpected := range tt.unexpected {
+				if strings.Contains(body, unexpected) {
+					t.Errorf("Got: %s, expected not to contain: %s", body, unexpected)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeHandlerObjectArrays(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"regions": [{"region": "us", "zone": "a", "latency": 12, "up": true}, {"region": "eu", "zone": "b", "latency": 30, "up": false}], "hosts": [{"name": "h1", "load": 2}, "h2"]}`))
+	}))
+	defer server.Close()
+
+	c, err := loadConfig(writeConfig(t, `
+modules:
+  all:
+    object_arrays:
+    - path: ^regions$
+      labels: [region, zone]
+  latency:
+    prefix: api
+    object_arrays:
+    - path: (regions|hosts)$
+      labels: [region]
+      values: [latency]
+`))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer func(c *Config) { config = c }(config)
+	config = c
+
+	testData := []struct {
+		name       string
+		module     string
+		expected   []string
+		unexpected []string
+	}{
+		{
+			name:   "all value fields",
+			module: "all",
+			expected: []string{
+				`latency{region="us",zone="a"} 12`,
+				`latency{region="eu",zone="b"} 30`,
+				`up{region="us",zone="a"} 1`,
+				`up{region="eu",zone="b"} 0`,
+				`hosts::array_0::load{array_0_index="0"} 2`,
+			},
+			unexpected: []string{"regions::"},
+		},
+		{
+			name:       "selected value fields",
+			module:     "latency",
+			expected:   []string{`api::latency{region="us"} 12`, `api::latency{region="eu"} 30`},
+			unexpected: []string{"up{", "zone="},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/probe?module="+tt.module+"&target="+server.URL, nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			body := rec.Body.String()
+			for _, expected := range tt.expected {
+				if !strings.Contains(body, expected) {
+					t.Errorf("Got: %s, expected to contain: %s", body, expected)
+				}
+			}
+			for _, unexpected := range tt.unexpected {
+				if strings.Contains(body, unexpected) {
+					t.Errorf("Got: %s, expected not to contain: %s", body, unexpected)
+				}
+			}
+		})
+	}
+}
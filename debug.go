@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/shiroyagicorp/prometheus-json-exporter/pkg/jsonwalk"
+)
+
+// debugSample describes a value found by the walk over a target's document.
+type debugSample struct {
+	// Path is the path of the value before sanitizing, as matched by
+	// include_path and the other path rules.
+	Path   string            `json:"path"`
+	Name   string            `json:"name,omitempty"`
+	Type   string            `json:"type,omitempty"`
+	Labels map[string]string `json:"labels"`
+	// Value is formatted like in the text exposition format, as JSON has
+	// no NaN or infinities.
+	Value string `json:"value"`
+	// Skipped tells why the value is not exported, if it is not.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// debugWalkHandler retrieves a target like probeHandler, but responds with
+// the values the walk over its document finds, as JSON, instead of
+// registering them. Strings, nulls and other values the walk ignores are
+// missing from the response. For a module with metrics, it responds with
+// the values they select instead.
+func debugWalkHandler(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if err := checkTarget(target); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	module, err := moduleFor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	release, ok := acquireProbeSlot(r.Context())
+	if !ok {
+		level.Warn(logger).Log("msg", "Too many concurrent probes, rejecting request", "max_concurrent_probes", cap(probeSlots))
+		http.Error(w, "Too many concurrent probes", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	jsonData, _, err := cachedProbeTarget(r.Context(), target, module.Probe)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// The labels of the module and of the document apply to every value,
+	// as in probe.
+	moduleLabels := map[string]string{}
+	for name, value := range module.Labels {
+		moduleLabels[name] = value
+	}
+	if len(module.LabelPaths) > 0 {
+		for name, value := range documentLabels(jsonData, module.LabelPaths) {
+			moduleLabels[name] = value
+		}
+	}
+
+	var samples []debugSample
+	if len(module.Metrics) > 0 {
+		samples, err = debugSelectSamples(module.Metrics, jsonData, moduleLabels, module.Walk, logger)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		jsonData, err = selectRoot(jsonData, module.Root)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		samples = debugWalkSamples(module, jsonData, moduleLabels, logger)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(samples)
+}
+
+// debugWalkSamples returns the values the walk over jsonData finds,
+// exported or not.
+func debugWalkSamples(module Module, jsonData interface{}, moduleLabels map[string]string, logger log.Logger) []debugSample {
+	samples := []debugSample{}
+	jsonwalk.WalkPath(module.Prefix, jsonData, []jsonwalk.Label{}, jsonwalk.ReceiverFunc(func(key string, value float64, labels []jsonwalk.Label) {
+		sample, skipped := module.Walk.NewSample(key, value, labels)
+		labelValues := map[string]string{}
+		for name, value := range moduleLabels {
+			labelValues[name] = value
+		}
+		for _, label := range labels {
+			labelValues[label.Name] = label.Value
+		}
+		if skipped == "" {
+			value = sample.Value
+		}
+		samples = append(samples, debugSample{
+			Path:    key,
+			Name:    sample.Name,
+			Type:    sample.Type,
+			Labels:  labelValues,
+			Value:   strconv.FormatFloat(value, 'g', -1, 64),
+			Skipped: skipped,
+		})
+	}), module.Walk, logger)
+	return samples
+}
+
+// debugSelectSamples returns the values metrics select from jsonData, by
+// registering them like a probe does and gathering them back. Their path
+// is the JSONPath expression of their metric.
+func debugSelectSamples(metrics []MetricConfig, jsonData interface{}, moduleLabels map[string]string, opts jsonwalk.Options, logger log.Logger) ([]debugSample, error) {
+	paths := make(map[string]string, len(metrics))
+	for _, metric := range metrics {
+		paths[metric.Name] = metric.Path
+	}
+
+	registry := prometheus.NewRegistry()
+	doSelectJSON(metrics, jsonData, prometheus.WrapRegistererWith(moduleLabels, registry), opts, logger)
+	families, err := registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	samples := []debugSample{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labelValues := map[string]string{}
+			for _, pair := range m.GetLabel() {
+				labelValues[pair.GetName()] = pair.GetValue()
+			}
+			samples = append(samples, debugSample{
+				Path:   paths[family.GetName()],
+				Name:   family.GetName(),
+				Type:   "gauge",
+				Labels: labelValues,
+				Value:  strconv.FormatFloat(m.GetGauge().GetValue(), 'g', -1, 64),
+			})
+		}
+	}
+	return samples, nil
+}
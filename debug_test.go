@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+func TestDebugWalkHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1, "y": {"z": [2.5]}, "name": "a"}`))
+	}))
+	defer server.Close()
+
+	defer func(m Module) { defaultModule = m }(defaultModule)
+	defaultModule.Walk.ExcludePath.Set("^x$")
+
+	req := httptest.NewRequest("GET", "/debug/walk?target="+server.URL, nil)
+	rec := httptest.NewRecorder()
+	debugWalkHandler(rec, req, log.NewNopLogger())
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status: %d, expected: %d", rec.Code, http.StatusOK)
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Got Content-Type: %s, expected: application/json", contentType)
+	}
+	var samples []debugSample
+	if err := json.Unmarshal(rec.Body.Bytes(), &samples); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := []debugSample{
+		{Path: "x", Labels: map[string]string{}, Value: "1", Skipped: "excluded by include_path or exclude_path"},
+		{Path: "y::z::array_0", Name: "y::z::array_0", Type: "gauge", Labels: map[string]string{"array_0_index": "0"}, Value: "2.5"},
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("Got: %+v, expected: %+v", samples, expected)
+	}
+}
+
+func TestDebugWalkHandlerMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"host": "a", "queues": [{"name": "q1", "size": 3}]}`))
+	}))
+	defer server.Close()
+
+	defer func(m Module) { defaultModule = m }(defaultModule)
+	defaultModule.LabelPaths = map[string]string{"host": "$.host"}
+	defaultModule.Metrics = []MetricConfig{{
+		Name:   "queue_size",
+		Path:   "$.queues[*].size",
+		Labels: map[string]string{"queue": "$.queues[*].name"},
+	}}
+
+	rec := httptest.NewRecorder()
+	debugWalkHandler(rec, httptest.NewRequest("GET", "/debug/walk?target="+server.URL, nil), log.NewNopLogger())
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status: %d, expected: %d", rec.Code, http.StatusOK)
+	}
+	var samples []debugSample
+	if err := json.Unmarshal(rec.Body.Bytes(), &samples); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := []debugSample{
+		{Path: "$.queues[*].size", Name: "queue_size", Type: "gauge", Labels: map[string]string{"host": "a", "queue": "q1"}, Value: "3"},
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("Got: %+v, expected: %+v", samples, expected)
+	}
+}
+
+func TestDebugWalkHandlerMaxConcurrentProbes(t *testing.T) {
+	defer func(slots chan struct{}, timeout time.Duration) {
+		probeSlots, probeQueueTimeout = slots, timeout
+	}(probeSlots, probeQueueTimeout)
+	probeSlots = make(chan struct{}, 1)
+	probeSlots <- struct{}{}
+	probeQueueTimeout = 10 * time.Millisecond
+
+	rec := httptest.NewRecorder()
+	debugWalkHandler(rec, httptest.NewRequest("GET", "/debug/walk?target=http://127.0.0.1:1", nil), log.NewNopLogger())
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestDebugWalkHandlerErrors(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	testData := []struct {
+		name     string
+		url      string
+		expected int
+	}{
+		{name: "missing target", url: "/debug/walk", expected: http.StatusBadRequest},
+		{name: "unknown module", url: "/debug/walk?target=" + unreachable.URL + "&module=missing", expected: http.StatusBadRequest},
+		{name: "unreachable target", url: "/debug/walk?target=" + unreachable.URL, expected: http.StatusBadGateway},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			debugWalkHandler(rec, httptest.NewRequest("GET", tt.url, nil), log.NewNopLogger())
+			if rec.Code != tt.expected {
+				t.Errorf("Got status: %d, expected: %d", rec.Code, tt.expected)
+			}
+		})
+	}
+}
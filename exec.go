@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExecConfig runs a command instead of requesting the target, parsing its
+// standard output as the document, for tools that only report as JSON on
+// the command line like ceph status --format json.
+type ExecConfig struct {
+	// Command is the program and its arguments. It is run directly, not
+	// through a shell.
+	Command []string `yaml:"command"`
+	// Env sets environment variables of the command. Only those and
+	// JSON_EXPORTER_TARGET, holding the probe's target, are set unless
+	// InheritEnv passes the exporter's environment along too.
+	Env        map[string]string `yaml:"env"`
+	InheritEnv bool              `yaml:"inherit_env"`
+	// Dir is the working directory of the command. Empty means the
+	// exporter's.
+	Dir string `yaml:"dir"`
+}
+
+func (c ExecConfig) validate() error {
+	if len(c.Command) == 0 || c.Command[0] == "" {
+		return fmt.Errorf("missing command")
+	}
+	for name := range c.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("invalid env variable name %q", name)
+		}
+	}
+	return nil
+}
+
+// execWaitDelay bounds how long a command's output is still read after it
+// exits or is killed, so that a process it started holding the output open
+// does not hang the probe.
+const execWaitDelay = time.Second
+
+// maxExecStderrBytes bounds how much of the standard error of a failed
+// command is kept for its error message.
+const maxExecStderrBytes = 1024
+
+// runExec runs the command of c for target, killing it once the probe's
+// timeout expires, and parses its output, which is XML or NDJSON only when
+// opts.Format says so. A command exiting with a non-zero status fails the
+// probe whatever its output.
+func runExec(ctx context.Context, target string, c ExecConfig, opts probeOptions) (interface{}, error) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+	cmd.Dir = c.Dir
+	cmd.Env = c.environ(target)
+	stdout := &limitedBuffer{max: opts.maxBodyBytes()}
+	stderr := &limitedBuffer{max: maxExecStderrBytes}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = execWaitDelay
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("running %s: timed out after %s", c.Command[0], timeout)
+		}
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("running %s: %v: %s", c.Command[0], err, message)
+		}
+		return nil, fmt.Errorf("running %s: %v", c.Command[0], err)
+	}
+	if stdout.truncated {
+		return nil, fmt.Errorf("output of %s too large: exceeds %d bytes", c.Command[0], stdout.max)
+	}
+	jsonData, err := parseDocument(stdout.Bytes(), opts.Format)
+	if err != nil {
+		return nil, fmt.Errorf("parsing output of %s: %w", c.Command[0], err)
+	}
+	return jsonData, nil
+}
+
+// environ returns the environment of the command run for target.
+func (c ExecConfig) environ(target string) []string {
+	var env []string
+	if c.InheritEnv {
+		env = os.Environ()
+	}
+	names := make([]string, 0, len(c.Env))
+	for name := range c.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+c.Env[name])
+	}
+	// Later values win, so the target cannot be overridden.
+	return append(env, "JSON_EXPORTER_TARGET="+target)
+}
+
+// limitedBuffer keeps the first max bytes written to it, discarding the
+// rest, so that a command writing endlessly neither blocks nor exhausts
+// memory.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - int64(b.buf.Len()); int64(len(p)) > room {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+func TestProbeTargetExec(t *testing.T) {
+	os.Setenv("JSON_EXPORTER_TEST_INHERITED", "inherited")
+	defer os.Unsetenv("JSON_EXPORTER_TEST_INHERITED")
+
+	testData := []struct {
+		name     string
+		exec     ExecConfig
+		opts     probeOptions
+		expected interface{}
+		err      string
+	}{
+		{
+			name:     "output",
+			exec:     ExecConfig{Command: []string{"echo", `{"x": 1}`}},
+			expected: map[string]interface{}{"x": json.Number("1")},
+		},
+		{
+			name:     "env",
+			exec:     ExecConfig{Command: []string{"sh", "-c", `echo "{\"target\": \"$JSON_EXPORTER_TARGET\", \"level\": \"$LEVEL\", \"inherited\": \"$JSON_EXPORTER_TEST_INHERITED\"}"`}, Env: map[string]string{"LEVEL": "2"}},
+			expected: map[string]interface{}{"target": "cluster-a", "level": "2", "inherited": ""},
+		},
+		{
+			name:     "inherited env",
+			exec:     ExecConfig{Command: []string{"sh", "-c", `echo "{\"inherited\": \"$JSON_EXPORTER_TEST_INHERITED\"}"`}, InheritEnv: true},
+			expected: map[string]interface{}{"inherited": "inherited"},
+		},
+		{
+			name: "failure",
+			exec: ExecConfig{Command: []string{"sh", "-c", "echo 'cluster unreachable' >&2; exit 3"}},
+			err:  "running sh: exit status 3: cluster unreachable",
+		},
+		{
+			name: "timeout",
+			exec: ExecConfig{Command: []string{"sleep", "5"}},
+			opts: probeOptions{Timeout: 50 * time.Millisecond},
+			err:  "running sleep: timed out after 50ms",
+		},
+		{
+			name: "timeout with output held open",
+			exec: ExecConfig{Command: []string{"sh", "-c", "sleep 10 & sleep 10"}},
+			opts: probeOptions{Timeout: 50 * time.Millisecond},
+			err:  "running sh: timed out after 50ms",
+		},
+		{
+			name: "output too large",
+			exec: ExecConfig{Command: []string{"echo", `{"x": 1}`}},
+			opts: probeOptions{MaxBodyBytes: 4},
+			err:  "output of echo too large",
+		},
+		{
+			name: "invalid output",
+			exec: ExecConfig{Command: []string{"echo", "not json"}},
+			err:  "parsing output of echo",
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Exec = &tt.exec
+			start := time.Now()
+			actual, resp, err := probeTarget(context.Background(), "cluster-a", opts)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Got: %s, expected the command to finish within 5s", elapsed)
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Got: %v, expected error containing: %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if resp != nil {
+				t.Errorf("Got response: %v, expected: nil", resp)
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerExecParseSuccess(t *testing.T) {
+	defer func(m Module) { defaultModule = m }(defaultModule)
+	defaultModule.Probe.Exec = &ExecConfig{Command: []string{"echo", "not json"}}
+
+	rec := httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", "/probe?target=cluster-a", nil), log.NewNopLogger())
+	body := rec.Body.String()
+	for _, expected := range []string{"probe_success 0\n", "json_parse_success 0\n"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Got: %s, expected to contain: %s", body, expected)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a compiled JSONPath expression. Only the subset needed to
+// select values is supported: the root $, child keys as .key or ['key'],
+// array indices as [n], and wildcards as .* or [*].
+type jsonPath []jsonPathSegment
+
+type jsonPathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// jsonPathMatch is a value selected by a jsonPath. Bindings holds the object
+// key or array index chosen at each wildcard on the way to the value.
+type jsonPathMatch struct {
+	Value    interface{}
+	Bindings []string
+}
+
+func parseJSONPath(expr string) (jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("invalid JSONPath %q: must start with $", expr)
+	}
+
+	var path jsonPath
+	rest := expr[1:]
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			return nil, fmt.Errorf("invalid JSONPath %q: recursive descent is not supported", expr)
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			if name == "" {
+				return nil, fmt.Errorf("invalid JSONPath %q: empty key", expr)
+			}
+			if name == "*" {
+				path = append(path, jsonPathSegment{wildcard: true})
+			} else {
+				path = append(path, jsonPathSegment{key: name})
+			}
+			rest = rest[end:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q: unterminated [", expr)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				path = append(path, jsonPathSegment{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				path = append(path, jsonPathSegment{key: inner[1 : len(inner)-1]})
+			default:
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid JSONPath %q: invalid index [%s]", expr, inner)
+				}
+				path = append(path, jsonPathSegment{index: index, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf("invalid JSONPath %q: unexpected %q", expr, rest)
+		}
+	}
+	return path, nil
+}
+
+// Select returns every value in jsonData matched by the path. Object keys
+// matched by wildcards are visited in sorted order.
+func (path jsonPath) Select(jsonData interface{}) []jsonPathMatch {
+	matches := []jsonPathMatch{{Value: jsonData}}
+	for _, segment := range path {
+		var next []jsonPathMatch
+		for _, match := range matches {
+			switch v := match.Value.(type) {
+			case map[string]interface{}:
+				if segment.wildcard {
+					keys := make([]string, 0, len(v))
+					for k := range v {
+						keys = append(keys, k)
+					}
+					sort.Strings(keys)
+					for _, k := range keys {
+						next = append(next, jsonPathMatch{Value: v[k], Bindings: withBinding(match.Bindings, k)})
+					}
+				} else if x, ok := v[segment.key]; ok && !segment.isIndex {
+					next = append(next, jsonPathMatch{Value: x, Bindings: match.Bindings})
+				}
+			case []interface{}:
+				if segment.wildcard {
+					for i, x := range v {
+						next = append(next, jsonPathMatch{Value: x, Bindings: withBinding(match.Bindings, strconv.Itoa(i))})
+					}
+				} else if segment.isIndex && segment.index < len(v) {
+					next = append(next, jsonPathMatch{Value: v[segment.index], Bindings: match.Bindings})
+				}
+			}
+		}
+		matches = next
+	}
+	return matches
+}
+
+// SelectBound returns the single value matched by the path when each of its
+// wildcards takes the next of bindings instead of matching everything. This
+// resolves a sibling path relative to a match of another path.
+func (path jsonPath) SelectBound(jsonData interface{}, bindings []string) (interface{}, bool) {
+	value := jsonData
+	for _, segment := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			key := segment.key
+			if segment.wildcard {
+				if len(bindings) == 0 {
+					return nil, false
+				}
+				key, bindings = bindings[0], bindings[1:]
+			} else if segment.isIndex {
+				return nil, false
+			}
+			x, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			value = x
+		case []interface{}:
+			index := segment.index
+			if segment.wildcard {
+				if len(bindings) == 0 {
+					return nil, false
+				}
+				i, err := strconv.Atoi(bindings[0])
+				if err != nil || i < 0 {
+					return nil, false
+				}
+				index, bindings = i, bindings[1:]
+			} else if !segment.isIndex {
+				return nil, false
+			}
+			if index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func withBinding(bindings []string, binding string) []string {
+	next := make([]string, len(bindings)+1)
+	copy(next, bindings)
+	next[len(bindings)] = binding
+	return next
+}
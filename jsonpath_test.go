@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	testData := []struct {
+		name     string
+		expr     string
+		expected jsonPath
+		err      bool
+	}{
+		{name: "root", expr: "$", expected: nil},
+		{name: "keys", expr: "$.a.b", expected: jsonPath{{key: "a"}, {key: "b"}}},
+		{name: "quoted key", expr: "$['a.b'][\"c\"]", expected: jsonPath{{key: "a.b"}, {key: "c"}}},
+		{name: "index", expr: "$.a[2]", expected: jsonPath{{key: "a"}, {index: 2, isIndex: true}}},
+		{name: "wildcards", expr: "$.*[*]", expected: jsonPath{{wildcard: true}, {wildcard: true}}},
+		{name: "missing root", expr: "a.b", err: true},
+		{name: "recursive descent", expr: "$..a", err: true},
+		{name: "empty key", expr: "$.a.", err: true},
+		{name: "unterminated bracket", expr: "$[0", err: true},
+		{name: "negative index", expr: "$[-1]", err: true},
+		{name: "unexpected character", expr: "$a", err: true},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := parseJSONPath(tt.expr)
+			if (err != nil) != tt.err {
+				t.Fatalf("Got error: %v, expected error: %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(path, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", path, tt.expected)
+			}
+		})
+	}
+}
+
+func TestJSONPathSelect(t *testing.T) {
+	var jsonData interface{}
+	if err := json.Unmarshal([]byte(`{"servers": {"b": {"load": [1, 2]}, "a": {"load": [3]}}, "name": "x"}`), &jsonData); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	testData := []struct {
+		name     string
+		expr     string
+		expected []jsonPathMatch
+	}{
+		{
+			name:     "key",
+			expr:     "$.name",
+			expected: []jsonPathMatch{{Value: "x"}},
+		},
+		{
+			name:     "missing key",
+			expr:     "$.missing",
+			expected: nil,
+		},
+		{
+			name:     "index",
+			expr:     "$.servers.b.load[1]",
+			expected: []jsonPathMatch{{Value: 2.0}},
+		},
+		{
+			name: "wildcards",
+			expr: "$.servers.*.load[*]",
+			expected: []jsonPathMatch{
+				{Value: 3.0, Bindings: []string{"a", "0"}},
+				{Value: 1.0, Bindings: []string{"b", "0"}},
+				{Value: 2.0, Bindings: []string{"b", "1"}},
+			},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := parseJSONPath(tt.expr)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			matches := path.Select(jsonData)
+			if !reflect.DeepEqual(matches, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", matches, tt.expected)
+			}
+		})
+	}
+}
+
+func TestJSONPathSelectBound(t *testing.T) {
+	var jsonData interface{}
+	if err := json.Unmarshal([]byte(`{"servers": [{"host": "a", "tags": {"env": "prod"}}, {"host": "b"}]}`), &jsonData); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	testData := []struct {
+		name     string
+		expr     string
+		bindings []string
+		expected interface{}
+		ok       bool
+	}{
+		{name: "bound index", expr: "$.servers[*].host", bindings: []string{"1"}, expected: "b", ok: true},
+		{name: "nested key", expr: "$.servers[*].tags.env", bindings: []string{"0"}, expected: "prod", ok: true},
+		{name: "missing sibling", expr: "$.servers[*].tags.env", bindings: []string{"1"}, ok: false},
+		{name: "missing binding", expr: "$.servers[*].host", bindings: nil, ok: false},
+		{name: "out of range", expr: "$.servers[*].host", bindings: []string{"2"}, ok: false},
+		{name: "negative binding", expr: "$.servers[*].host", bindings: []string{"-1"}, ok: false},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := parseJSONPath(tt.expr)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			value, ok := path.SelectBound(jsonData, tt.bindings)
+			if ok != tt.ok || !reflect.DeepEqual(value, tt.expected) {
+				t.Errorf("Got: %v, %v, expected: %v, %v", value, ok, tt.expected, tt.ok)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerMetricsNegativeKeyBinding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"a": {"-1": {"v": 1}}, "b": [{"n": "x"}]}`))
+	}))
+	defer server.Close()
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{Modules: map[string]Module{
+		"keys": {Metrics: []MetricConfig{{Name: "v", Path: "$.a.*.v", Labels: map[string]string{"n": "$.b[*].n"}}}},
+	}}
+
+	req := httptest.NewRequest("GET", "/probe?module=keys&target="+server.URL, nil)
+	rec := httptest.NewRecorder()
+	probeHandler(rec, req, log.NewNopLogger())
+
+	if body := rec.Body.String(); !strings.Contains(body, `v{n=""} 1`) {
+		t.Errorf("Got: %s, expected to contain: %s", body, `v{n=""} 1`)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// probeSlots bounds how many probe requests are served at the same time,
+// holding a value for each one in flight. Nil means no limit.
+var probeSlots chan struct{}
+
+// probeQueueTimeout is how long a probe request waits for a slot before
+// failing.
+var probeQueueTimeout = time.Second
+
+var probesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "json_exporter_probes_in_flight",
+	Help: "Number of probe requests currently being served",
+})
+
+func init() {
+	prometheus.MustRegister(probesInFlight)
+}
+
+// acquireProbeSlot waits up to probeQueueTimeout for a probe request to be
+// allowed to run, reporting false if it is not. Otherwise release must be
+// called once the request is served.
+func acquireProbeSlot(ctx context.Context) (release func(), ok bool) {
+	if probeSlots != nil {
+		timer := time.NewTimer(probeQueueTimeout)
+		defer timer.Stop()
+		select {
+		case probeSlots <- struct{}{}:
+		case <-timer.C:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+	probesInFlight.Inc()
+	return func() {
+		probesInFlight.Dec()
+		if probeSlots != nil {
+			<-probeSlots
+		}
+	}, true
+}
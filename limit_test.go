@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProbeHandlerMaxConcurrentProbes(t *testing.T) {
+	defer func(slots chan struct{}, timeout time.Duration) {
+		probeSlots, probeQueueTimeout = slots, timeout
+	}(probeSlots, probeQueueTimeout)
+	probeSlots = make(chan struct{}, 1)
+	probeQueueTimeout = 50 * time.Millisecond
+
+	started, unblock := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-unblock
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		probeHandler(rec, httptest.NewRequest("GET", "/probe?target="+server.URL+"/slow", nil), log.NewNopLogger())
+		done <- rec.Code
+	}()
+	<-started
+
+	if got := testutil.ToFloat64(probesInFlight); got != 1 {
+		t.Errorf("Got in flight: %v, expected: 1", got)
+	}
+	rec := httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", "/probe?target="+server.URL, nil), log.NewNopLogger())
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	close(unblock)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Got status: %d, expected: %d", code, http.StatusOK)
+	}
+	if got := testutil.ToFloat64(probesInFlight); got != 0 {
+		t.Errorf("Got in flight: %v, expected: 0", got)
+	}
+
+	rec = httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", "/probe?target="+server.URL, nil), log.NewNopLogger())
+	if rec.Code != http.StatusOK {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusOK)
+	}
+}
@@ -1,175 +1,1725 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promlog"
+	"github.com/prometheus/common/version"
+	"github.com/prometheus/exporter-toolkit/web"
+
+	"github.com/shiroyagicorp/prometheus-json-exporter/pkg/jsonwalk"
+)
+
+// probeOptions describes how the request to a target is made.
+type probeOptions struct {
+	// Username and Password enable HTTP basic auth when Username is set.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// PasswordFile holds the Password instead, re-read on every probe so
+	// rotated secrets are picked up.
+	PasswordFile string `yaml:"password_file"`
+	// BearerToken is sent as "Authorization: Bearer <token>".
+	BearerToken string `yaml:"bearer_token"`
+	// BearerTokenFile holds the BearerToken instead, e.g. a Kubernetes
+	// service account token, re-read on every probe.
+	BearerTokenFile string `yaml:"bearer_token_file"`
+	// OAuth2 fetches the bearer token from an OAuth2 token endpoint,
+	// caching it until it expires.
+	OAuth2 *OAuth2Config `yaml:"oauth2"`
+	// Authorization is sent verbatim as the Authorization header when no
+	// other credentials or Authorization header are given. It is passed
+	// through from the scraper with ForwardAuthorization, which cannot be
+	// set along with -web.config.file, as the header then holds the
+	// exporter's own credentials.
+	Authorization        string `yaml:"-"`
+	ForwardAuthorization bool   `yaml:"forward_authorization"`
+	// Timeout bounds the whole request including reading the body.
+	// Zero means defaultTimeout.
+	Timeout time.Duration `yaml:"timeout"`
+	TLS     TLSConfig     `yaml:"tls_config"`
+	// Method is the HTTP method of the request. Empty means GET.
+	Method string `yaml:"method"`
+	// Body is sent as the request body, with ContentType as its
+	// Content-Type header. It is a Go template expanded with the probe's
+	// query parameters, see expandBody.
+	Body        string `yaml:"body"`
+	ContentType string `yaml:"content_type"`
+	// Headers are added to the request. Their values are never logged.
+	Headers map[string]headerValues `yaml:"headers"`
+	// MaxBodyBytes bounds the size of the (decompressed) response body.
+	// Zero means defaultMaxBodyBytes.
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+	// ValidStatusCodes lists the response status codes whose body is
+	// parsed. Any other status fails the probe. Empty accepts any 2xx
+	// status.
+	ValidStatusCodes []int `yaml:"valid_status_codes"`
+	// MaxRetries retries requests failing with a network error or one of
+	// RetryStatusCodes up to this many times, waiting RetryBaseDelay before
+	// the first retry and doubling the delay for each one after. Retries
+	// stop once Timeout expires.
+	MaxRetries     int           `yaml:"max_retries"`
+	RetryBaseDelay time.Duration `yaml:"retry_base_delay"`
+	// RetryStatusCodes lists the status codes worth retrying. Empty means
+	// defaultRetryStatusCodes.
+	RetryStatusCodes []int `yaml:"retry_status_codes"`
+	// ProxyURL is the http://, https:// or socks5:// URL of the proxy to
+	// send requests through. Empty means the proxy given by the environment.
+	ProxyURL string `yaml:"proxy_url"`
+	// FollowRedirects follows up to MaxRedirects redirects, 10 if zero.
+	// Otherwise the probe reports on the redirect response itself.
+	FollowRedirects bool `yaml:"follow_redirects"`
+	MaxRedirects    int  `yaml:"max_redirects"`
+	// RedirectForwardAuth sends the Authorization header of the request
+	// to the target along redirects to other hosts too, which only get it
+	// by default when they are the target's host or a subdomain of it.
+	RedirectForwardAuth bool `yaml:"redirect_forward_auth"`
+	// IgnoreContentType parses responses whatever their Content-Type,
+	// for servers that do not label their JSON as such.
+	IgnoreContentType bool `yaml:"ignore_content_type"`
+	// Format is the format of the document, "json", "xml" or "ndjson".
+	// Empty means JSON, unless the Content-Type of the response is XML or
+	// NDJSON.
+	Format string `yaml:"format"`
+	// Exec runs a command to get the document instead of requesting the
+	// target, see ExecConfig.
+	Exec *ExecConfig `yaml:"exec"`
+	// NoCache retrieves the target even if a cached document is available.
+	NoCache bool `yaml:"-"`
+}
+
+func (opts probeOptions) validStatusCode(code int) bool {
+	if len(opts.ValidStatusCodes) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, valid := range opts.ValidStatusCodes {
+		if code == valid {
+			return true
+		}
+	}
+	return false
+}
+
+func (opts probeOptions) retryStatusCode(code int) bool {
+	codes := opts.RetryStatusCodes
+	if len(codes) == 0 {
+		codes = defaultRetryStatusCodes
+	}
+	for _, retry := range codes {
+		if code == retry {
+			return true
+		}
+	}
+	return false
+}
+
+// headerValues holds the values of a header, which may be given in YAML as
+// a single string or as a list.
+type headerValues []string
+
+func (h *headerValues) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*h = headerValues{value}
+		return nil
+	}
+	var values []string
+	if err := unmarshal(&values); err != nil {
+		return err
+	}
+	*h = values
+	return nil
+}
+
+// TLSConfig describes how the TLS certificates of targets are verified.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of CA certificates to verify targets against
+	// instead of the system pool.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile hold a PEM client certificate and its key to
+	// present to targets requiring one. They are read on every handshake,
+	// so renewed certificates are picked up.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ServerName is the name to verify target certificates against and to
+	// send for SNI, instead of the host of the target.
+	ServerName string `yaml:"server_name"`
+	// MinVersion is the oldest TLS version to accept, one of TLS10, TLS11,
+	// TLS12 or TLS13. Empty means the Go default.
+	MinVersion string `yaml:"min_version"`
+	// InsecureSkipVerify disables verification, e.g. for targets known to
+	// use self-signed certificates.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+const (
+	defaultTimeout      = 10 * time.Second
+	defaultMaxBodyBytes = 16 << 20
 )
 
-type ReceiverFunc func(key string, value float64, indices []int, gaugeVecs map[string]*prometheus.GaugeVec)
+// scrapeTimeoutOffset is subtracted from the scrape timeout Prometheus
+// sends, leaving time to send the response before it gives up.
+var scrapeTimeoutOffset = 500 * time.Millisecond
+
+// defaultRetryStatusCodes are the statuses of gateways failing to reach a
+// target that is being restarted.
+var defaultRetryStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// parseTimeout accepts either a Go duration like "5s" or a number of
+// seconds like "4.5", as sent in X-Prometheus-Scrape-Timeout-Seconds.
+func parseTimeout(s string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(s)
+	if err != nil {
+		seconds, ferr := strconv.ParseFloat(s, 64)
+		if ferr != nil {
+			return 0, fmt.Errorf("invalid timeout %q", s)
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q: must be positive", s)
+	}
+	return timeout, nil
+}
+
+// readCredentialFiles returns opts with Password and BearerToken read from
+// PasswordFile and BearerTokenFile, unless already given. Missing and empty
+// files are errors, rather than sending requests without credentials.
+func (opts probeOptions) readCredentialFiles() (probeOptions, error) {
+	var err error
+	if opts.PasswordFile != "" && opts.Password == "" {
+		if opts.Password, err = readCredentialFile("password", opts.PasswordFile); err != nil {
+			return opts, err
+		}
+	}
+	if opts.BearerTokenFile != "" && opts.BearerToken == "" {
+		if opts.BearerToken, err = readCredentialFile("bearer token", opts.BearerTokenFile); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
 
-func (receiver ReceiverFunc) Receive(key string, value float64, indices []int, gaugeVecs map[string]*prometheus.GaugeVec) {
-	receiver(key, value, indices, gaugeVecs)
+// readCredentialFile returns the contents of the file at path holding a
+// credential of the given kind, without surrounding whitespace.
+func readCredentialFile(kind, path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %s file: %v", kind, err)
+	}
+	credential := strings.TrimSpace(string(data))
+	if credential == "" {
+		return "", fmt.Errorf("%s file %s is empty", kind, path)
+	}
+	return credential, nil
 }
 
-type Receiver interface {
-	Receive(key string, value float64, indices []int, gaugeVecs map[string]*prometheus.GaugeVec)
+func (opts probeOptions) setAuth(req *http.Request) {
+	switch {
+	case opts.Username != "":
+		req.SetBasicAuth(opts.Username, opts.Password)
+	case opts.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+opts.BearerToken)
+	case opts.Authorization != "" && req.Header.Get("Authorization") == "":
+		req.Header.Set("Authorization", opts.Authorization)
+	}
 }
 
-func WalkJSON(path string, jsonData interface{}, indices []int, gaugeVecs map[string]*prometheus.GaugeVec, receiver Receiver) {
-	switch v := jsonData.(type) {
-	case int:
-		receiver.Receive(path, float64(v), indices, gaugeVecs)
-	case float64:
-		receiver.Receive(path, v, indices, gaugeVecs)
-	case bool:
-		n := 0.0
-		if v {
-			n = 1.0
+// doProbe requests target and parses the response as JSON. The response is
+// returned whenever one was received, even along with an error, so that its
+// status can be reported; its body is already closed.
+func doProbe(ctx context.Context, client *http.Client, target string, opts probeOptions) (interface{}, *http.Response, error) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	opts, err := opts.readCredentialFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.OAuth2 != nil {
+		if opts.BearerToken, err = oauth2Token(ctx, client, *opts.OAuth2); err != nil {
+			return nil, nil, fmt.Errorf("fetching OAuth2 token: %v", err)
 		}
-		receiver.Receive(path, n, indices, gaugeVecs)
-	case string:
-		// ignore
-	case nil:
-		// ignore
-	case []interface{}:
-		prefix := ""
-		if path != "" {
-			prefix = path + "::"
+	}
+
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest(ctx, target, opts)
+		if err != nil {
+			return nil, nil, err
 		}
-		indicesNext := make([]int, len(indices)+1)
-		copy(indicesNext, indices)
-		for i, x := range v {
-			indicesNext[len(indices)] = i
-			WalkJSON(fmt.Sprintf("%sarray_%d", prefix, len(indices)), x, indicesNext, gaugeVecs, receiver)
+		resp, err = client.Do(req)
+		if err != nil || !opts.validStatusCode(resp.StatusCode) {
+			httpErrorsTotal.Inc()
 		}
-	case map[string]interface{}:
-		prefix := ""
-		if path != "" {
-			prefix = strings.ReplaceAll(path, "-", "_") + "::"
+		retry := attempt < opts.MaxRetries &&
+			(err != nil && ctx.Err() == nil || err == nil && opts.retryStatusCode(resp.StatusCode))
+		if !retry {
+			if err != nil {
+				return nil, nil, err
+			}
+			break
 		}
-		for k, x := range v {
-			WalkJSON(fmt.Sprintf("%s%s", prefix, k), x, indices, gaugeVecs, receiver)
+		if err == nil {
+			resp.Body.Close()
 		}
-	default:
-		log.Printf("unkown type: %#v", v)
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return nil, nil, err
+			}
+			return nil, resp, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		case <-time.After(opts.RetryBaseDelay << uint(attempt)):
+		}
+		probeTraceFrom(ctx).retried()
+	}
+	defer resp.Body.Close()
+
+	if !opts.validStatusCode(resp.StatusCode) {
+		return nil, resp, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	format := opts.Format
+	if format == "" {
+		switch {
+		case isXMLContentType(contentType):
+			format = "xml"
+		case isNDJSONContentType(contentType):
+			format = "ndjson"
+		}
+	}
+	if (format == "" || format == "json") && !opts.IgnoreContentType && !isJSONContentType(contentType) {
+		return nil, resp, fmt.Errorf("unexpected Content-Type %q, expected JSON", contentType)
+	}
+
+	// The transport only decompresses gzip responses it asked for itself,
+	// and newRequest asks for more, so decompress them here.
+	encoding := resp.Header.Get("Content-Encoding")
+	reader, err := decompress(resp.Body, encoding, opts.maxBodyBytes())
+	if err != nil {
+		return nil, resp, fmt.Errorf("decompressing %s response: %v", encoding, err)
+	}
+	defer reader.Close()
+
+	data, err := readLimited(reader, opts.maxBodyBytes())
+	if err != nil {
+		return nil, resp, err
+	}
+	trace := probeTraceFrom(ctx)
+	trace.mark(&trace.bodyRead)
+	jsonData, err := parseDocument(data, format)
+	trace.mark(&trace.parsed)
+	return jsonData, resp, err
+}
+
+// isJSONContentType reports whether contentType is application/json or a
+// structured syntax suffix type like application/problem+json.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// newRequest builds a request to target. Each retry needs a new one, as
+// sending a request consumes its body.
+func newRequest(ctx context.Context, target string, opts probeOptions) (*http.Request, error) {
+	method := opts.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if opts.Body != "" {
+		body = strings.NewReader(opts.Body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range opts.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if opts.ContentType != "" {
+		req.Header.Set("Content-Type", opts.ContentType)
 	}
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	opts.setAuth(req)
+	return req, nil
 }
 
-func doProbe(client *http.Client, target string) (interface{}, error) {
-	resp, err := client.Get(target)
+func (opts probeOptions) maxBodyBytes() int64 {
+	if opts.MaxBodyBytes == 0 {
+		return defaultMaxBodyBytes
+	}
+	return opts.MaxBodyBytes
+}
+
+// readLimited reads all of reader, failing if it holds more than maxBytes.
+func readLimited(reader io.Reader, maxBytes int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxBytes+1))
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("response too large: exceeds %d bytes", maxBytes)
+	}
+	return data, nil
+}
+
+// parseError is the error of a document that was read but could not be
+// parsed, telling malformed responses apart from failures to retrieve them.
+type parseError struct {
+	err error
+}
 
-	bytes, err := ioutil.ReadAll(resp.Body)
+func (e *parseError) Error() string {
+	return e.err.Error()
+}
+
+// readDocument parses the document in reader in format like parseDocument,
+// failing if it is larger than maxBytes.
+func readDocument(reader io.Reader, format string, maxBytes int64) (interface{}, error) {
+	data, err := readLimited(reader, maxBytes)
 	if err != nil {
 		return nil, err
 	}
+	return parseDocument(data, format)
+}
 
+// parseDocument parses data as XML or NDJSON when format says so and as
+// JSON otherwise.
+func parseDocument(data []byte, format string) (interface{}, error) {
 	var jsonData interface{}
-	err = json.Unmarshal([]byte(bytes), &jsonData)
+	var err error
+	switch format {
+	case "xml":
+		jsonData, err = parseXML(data)
+	case "ndjson":
+		jsonData, err = parseNDJSON(data)
+	default:
+		jsonData, err = parseJSON(data)
+	}
 	if err != nil {
+		return nil, &parseError{err: err}
+	}
+	return jsonData, nil
+}
+
+// parseJSON parses the JSON document in data.
+func parseJSON(data []byte) (interface{}, error) {
+	// Decode numbers as json.Number, so that integers too large for a
+	// float64 can be detected and out of range numbers are not rejected.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var jsonData interface{}
+	if err := decoder.Decode(&jsonData); err != nil {
 		return nil, err
 	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid data after top-level value")
+	}
 
 	return jsonData, nil
 }
 
-var httpClient *http.Client
+// probeTarget retrieves target according to its scheme: file:// targets are
+// read from disk, unix:// targets are requested over a unix domain socket
+// and anything else is requested over HTTP. Modules with an exec command
+// run it instead, whatever the target. The response is nil unless the
+// target was requested over HTTP.
+func probeTarget(ctx context.Context, target string, opts probeOptions) (interface{}, *http.Response, error) {
+	switch {
+	case opts.Exec != nil:
+		jsonData, err := runExec(ctx, target, *opts.Exec, opts)
+		return jsonData, nil, err
+	case strings.HasPrefix(target, "file://"):
+		jsonData, err := readFileTarget(target, opts)
+		return jsonData, nil, err
+	case strings.HasPrefix(target, "unix://"):
+		socket, path := splitUnixTarget(target)
+		client, err := httpClientFor(opts.TLS, socket, "", opts.redirectPolicy())
+		if err != nil {
+			return nil, nil, err
+		}
+		return doProbe(ctx, client, "http://unix"+path, opts)
+	default:
+		client, err := httpClientFor(opts.TLS, "", opts.ProxyURL, opts.redirectPolicy())
+		if err != nil {
+			return nil, nil, err
+		}
+		return doProbe(ctx, client, target, opts)
+	}
+}
 
-func init() {
-	httpClient = &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConns: 100,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
+// readFileTarget reads the document of a file:///path/to/file target, which
+// is XML or NDJSON only when opts.Format says so.
+func readFileTarget(target string, opts probeOptions) (interface{}, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("invalid file target %q: expected file:///absolute/path", target)
+	}
+	path, err := checkFile(u.Path)
+	if err != nil {
+		return nil, err
 	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	jsonData, err := readDocument(f, opts.Format, opts.maxBodyBytes())
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", u.Path, err)
+	}
+	return jsonData, nil
+}
+
+// splitUnixTarget splits a unix:///path/to/socket:/request/path target into
+// the socket and the request path, which defaults to "/".
+func splitUnixTarget(target string) (string, string) {
+	socket := strings.TrimPrefix(target, "unix://")
+	path := "/"
+	if i := strings.Index(socket, ":"); i >= 0 {
+		socket, path = socket[:i], socket[i+1:]
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return socket, path
+}
+
+func (c TLSConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify, ServerName: c.ServerName}
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid min_version %q, expected TLS10, TLS11, TLS12 or TLS13", c.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if c.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+type httpClientKey struct {
+	tls       TLSConfig
+	socket    string
+	proxyURL  string
+	redirects redirectPolicy
+}
+
+// defaultMaxRedirects is how many redirects are followed when MaxRedirects
+// is not set, like net/http does.
+const defaultMaxRedirects = 10
+
+// redirectPolicy is how a client handles redirects, see FollowRedirects.
+type redirectPolicy struct {
+	follow      bool
+	max         int
+	forwardAuth bool
+}
+
+func (opts probeOptions) redirectPolicy() redirectPolicy {
+	max := opts.MaxRedirects
+	if max == 0 {
+		max = defaultMaxRedirects
+	}
+	return redirectPolicy{follow: opts.FollowRedirects, max: max, forwardAuth: opts.RedirectForwardAuth}
+}
+
+// checkRedirect implements http.Client.CheckRedirect, counting the
+// redirects followed in the probe's trace. Redirects must lead to targets
+// allowed by checkTarget too.
+func (p redirectPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if !p.follow {
+		return http.ErrUseLastResponse
+	}
+	if len(via) > p.max {
+		return fmt.Errorf("stopped after %d redirects", p.max)
+	}
+	if err := checkTarget(req.URL.String()); err != nil {
+		return err
+	}
+	probeTraceFrom(req.Context()).setRedirects(len(via))
+	if p.forwardAuth && req.Header.Get("Authorization") == "" {
+		if auth := via[0].Header.Get("Authorization"); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+	}
+	return nil
+}
+
+var (
+	httpClientsMu sync.Mutex
+	// httpClients holds a client per TLS configuration, unix socket, proxy
+	// and redirect policy, so that probes sharing them reuse connections.
+	httpClients = map[httpClientKey]*http.Client{}
+)
+
+// httpClientFor returns the client for probing targets with the given TLS
+// configuration. If socket is set, the client connects to that unix domain
+// socket whatever the host of the request. Otherwise requests go through the
+// proxy at proxyURL, or if empty the one given by the HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables. Redirects are handled
+// according to redirects.
+func httpClientFor(c TLSConfig, socket, proxyURL string, redirects redirectPolicy) (*http.Client, error) {
+	httpClientsMu.Lock()
+	defer httpClientsMu.Unlock()
+
+	key := httpClientKey{tls: c, socket: socket, proxyURL: proxyURL, redirects: redirects}
+	if client, ok := httpClients[key]; ok {
+		return client, nil
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: checkDial}
+	transport := &http.Transport{
+		MaxIdleConns:    100,
+		TLSClientConfig: tlsConfig,
+		DialContext:     dialer.DialContext,
+	}
+	switch {
+	case socket != "":
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	case proxyURL != "":
+		u, err := parseProxyURL(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(u)
+	default:
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	client := &http.Client{Transport: transport, CheckRedirect: redirects.checkRedirect}
+	httpClients[key] = client
+	return client, nil
+}
+
+// parseProxyURL parses the URL of an HTTP, HTTPS or SOCKS5 proxy.
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL %q: expected an http, https or socks5 URL", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", s)
+	}
+	return u, nil
+}
+
+// doWalkJSON registers the samples jsonwalk collects from jsonData into
+// registry, logging and counting those that cannot be registered.
+func doWalkJSON(prefix string, jsonData interface{}, registry prometheus.Registerer, opts jsonwalk.Options, logger log.Logger) jsonwalk.Stats {
+	return newWalkVecs().walkJSON(prefix, jsonData, registry, opts, logger)
 }
 
-func doWalkJSON(prefix string, jsonData interface{}, registry *prometheus.Registry) {
-	WalkJSON(prefix, jsonData, []int{}, map[string]*prometheus.GaugeVec{}, ReceiverFunc(func(key string, value float64, indices []int, gaugeVecs map[string]*prometheus.GaugeVec) {
+// walkJSON is doWalkJSON, exporting the samples with the vectors in v.
+func (v *walkVecs) walkJSON(prefix string, jsonData interface{}, registry prometheus.Registerer, opts jsonwalk.Options, logger log.Logger) jsonwalk.Stats {
+	samples, stats := jsonwalk.Collect(prefix, jsonData, opts, logger)
+	v.reset()
+
+	counterVecs := map[string]*prometheus.CounterVec{}
+	gaugeVecs := map[string]*prometheus.GaugeVec{}
+	untypedVecs := map[string]*untypedVec{}
+	histogramVecs := map[string]*prometheus.HistogramVec{}
+	timestamps := map[string]map[string]time.Time{}
+	series := map[string]string{}
+	for _, sample := range samples {
+		key, help, value := sample.Name, sample.Help, sample.Value
+		labelNames := make([]string, len(sample.Labels))
+		for i, label := range sample.Labels {
+			labelNames[i] = label.Name
+		}
+		labelsWithValues := prometheus.Labels{}
+		for _, label := range sample.Labels {
+			labelsWithValues[label.Name] = label.Value
+		}
+
+		// Different paths can sanitize to the same series, e.g. a-b and
+		// a_b. Keep the first rather than overwriting it, or adding to it
+		// for counters. The observations of a histogram share its path.
+		id := seriesID(key, labelsWithValues)
+		if path, ok := series[id]; ok && (sample.Type != "histogram" || path != sample.Path) {
+			level.Warn(logger).Log("msg", "Skipping value", "metric", key, "path", sample.Path, "err", fmt.Sprintf("duplicate of the series exported for %s", path))
+			walkErrorsTotal.Inc()
+			continue
+		}
+		series[id] = sample.Path
+
+		if sample.Type == "untyped" {
+			u, ok := untypedVecs[key]
+			if !ok {
+				u = v.untypedVec(key, help, labelNames)
+				untypedVecs[key] = u
+				timestamps[key] = map[string]time.Time{}
+				if err := registry.Register(timestampedCollector{u, timestamps[key]}); err != nil {
+					level.Warn(logger).Log("msg", "Skipping metric", "metric", key, "err", err)
+					walkErrorsTotal.Inc()
+				}
+			}
+			if err := u.Set(labelsWithValues, value); err != nil {
+				level.Warn(logger).Log("msg", "Skipping value", "metric", key, "err", err)
+				walkErrorsTotal.Inc()
+				continue
+			}
+			if !sample.Timestamp.IsZero() {
+				timestamps[key][seriesID("", labelsWithValues)] = sample.Timestamp
+			}
+			continue
+		}
+
+		if sample.Type == "histogram" {
+			h, ok := histogramVecs[key]
+			if !ok {
+				h = v.histogramVec(key, help, sample.Buckets, labelNames)
+				histogramVecs[key] = h
+				timestamps[key] = map[string]time.Time{}
+				if err := registry.Register(timestampedCollector{h, timestamps[key]}); err != nil {
+					level.Warn(logger).Log("msg", "Skipping metric", "metric", key, "err", err)
+					walkErrorsTotal.Inc()
+				}
+			}
+			observer, err := h.GetMetricWith(labelsWithValues)
+			if err != nil {
+				level.Warn(logger).Log("msg", "Skipping value", "metric", key, "err", err)
+				walkErrorsTotal.Inc()
+				continue
+			}
+			observer.Observe(value)
+			if !sample.Timestamp.IsZero() {
+				timestamps[key][seriesID("", labelsWithValues)] = sample.Timestamp
+			}
+			continue
+		}
+
+		if sample.Type == "counter" {
+			// Every probe registers fresh or reset counters, so adding
+			// the value sets them to it.
+			c, ok := counterVecs[key]
+			if !ok {
+				c = v.counterVec(key, help, labelNames)
+				counterVecs[key] = c
+				timestamps[key] = map[string]time.Time{}
+				if err := registry.Register(timestampedCollector{c, timestamps[key]}); err != nil {
+					level.Warn(logger).Log("msg", "Skipping metric", "metric", key, "err", err)
+					walkErrorsTotal.Inc()
+				}
+			}
+			counter, err := c.GetMetricWith(labelsWithValues)
+			if err != nil {
+				level.Warn(logger).Log("msg", "Skipping value", "metric", key, "err", err)
+				walkErrorsTotal.Inc()
+				continue
+			}
+			counter.Add(value)
+			if !sample.Timestamp.IsZero() {
+				timestamps[key][seriesID("", labelsWithValues)] = sample.Timestamp
+			}
+			continue
+		}
+
 		g, ok := gaugeVecs[key]
 		if !ok {
-			labels := make([]string, len(indices))
-			for array, _ := range indices {
-				labels[array] = fmt.Sprintf("array_%d_index", array)
-			}
-			g = prometheus.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Name: key,
-					Help: "Retrieved value",
-				},
-				labels,
-			)
+			g = v.gaugeVec(key, help, labelNames)
 			gaugeVecs[key] = g
-			registry.MustRegister(g)
+			timestamps[key] = map[string]time.Time{}
+			if err := registry.Register(timestampedCollector{g, timestamps[key]}); err != nil {
+				level.Warn(logger).Log("msg", "Skipping metric", "metric", key, "err", err)
+				walkErrorsTotal.Inc()
+			}
 		}
-		labelsWithValues := prometheus.Labels{}
-		for array, index := range indices {
-			labelsWithValues[fmt.Sprintf("array_%d_index", array)] = strconv.Itoa(index)
+		gauge, err := g.GetMetricWith(labelsWithValues)
+		if err != nil {
+			level.Warn(logger).Log("msg", "Skipping value", "metric", key, "err", err)
+			walkErrorsTotal.Inc()
+			continue
+		}
+		gauge.Set(value)
+		if !sample.Timestamp.IsZero() {
+			timestamps[key][seriesID("", labelsWithValues)] = sample.Timestamp
+		}
+	}
+	return stats
+}
+
+// timestampedCollector collects the metrics of a vector, giving those of the
+// series in timestamps, by their seriesID without a name, their timestamp.
+type timestampedCollector struct {
+	prometheus.Collector
+	timestamps map[string]time.Time
+}
+
+func (c timestampedCollector) Collect(ch chan<- prometheus.Metric) {
+	if len(c.timestamps) == 0 {
+		c.Collector.Collect(ch)
+		return
+	}
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.Collector.Collect(metrics)
+		close(metrics)
+	}()
+	for metric := range metrics {
+		var m dto.Metric
+		if err := metric.Write(&m); err == nil {
+			labels := prometheus.Labels{}
+			for _, pair := range m.Label {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			if t, ok := c.timestamps[seriesID("", labels)]; ok {
+				metric = prometheus.NewMetricWithTimestamp(t, metric)
+			}
 		}
-		g.With(labelsWithValues).Set(value)
-	}))
+		ch <- metric
+	}
 }
 
-func probeHandler(w http.ResponseWriter, r *http.Request) {
+// seriesID identifies the series of the metric name with labels.
+func seriesID(name string, labels prometheus.Labels) string {
+	names := make([]string, 0, len(labels))
+	for labelName := range labels {
+		names = append(names, labelName)
+	}
+	sort.Strings(names)
+	id := name
+	for _, labelName := range names {
+		id += "\xff" + labelName + "\xff" + labels[labelName]
+	}
+	return id
+}
+
+// doSelectJSON registers the metrics whose values are selected from
+// jsonData by JSONPath.
+func doSelectJSON(metrics []MetricConfig, jsonData interface{}, registry prometheus.Registerer, opts jsonwalk.Options, logger log.Logger) {
+	type sample struct {
+		labels prometheus.Labels
+		value  float64
+	}
+
+	for _, metric := range metrics {
+		path, err := parseJSONPath(metric.Path)
+		if err != nil {
+			level.Warn(logger).Log("msg", "Skipping metric", "metric", metric.Name, "err", err)
+			walkErrorsTotal.Inc()
+			continue
+		}
+		labelPaths := map[string]jsonPath{}
+		for name, expr := range metric.Labels {
+			if labelPaths[name], err = parseJSONPath(expr); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			level.Warn(logger).Log("msg", "Skipping metric", "metric", metric.Name, "err", err)
+			walkErrorsTotal.Inc()
+			continue
+		}
+
+		var samples []sample
+		indexed := false
+		for _, match := range path.Select(jsonData) {
+			labels := prometheus.Labels{}
+			for name, labelPath := range labelPaths {
+				value, _ := labelPath.SelectBound(jsonData, match.Bindings)
+				labels[name] = jsonwalk.LabelValue(value)
+			}
+			if values, ok := match.Value.([]interface{}); ok {
+				indexed = true
+				for i, x := range values {
+					if value, ok := jsonwalk.Value(x, opts); ok {
+						elementLabels := prometheus.Labels{"index": strconv.Itoa(i)}
+						for name, value := range labels {
+							elementLabels[name] = value
+						}
+						samples = append(samples, sample{labels: elementLabels, value: value})
+					}
+				}
+				continue
+			}
+			if value, ok := jsonwalk.Value(match.Value, opts); ok {
+				samples = append(samples, sample{labels: labels, value: value})
+			}
+		}
+
+		labelNames := make([]string, 0, len(labelPaths)+1)
+		for name := range labelPaths {
+			labelNames = append(labelNames, name)
+		}
+		if indexed {
+			labelNames = append(labelNames, "index")
+		}
+		sort.Strings(labelNames)
+
+		help := metric.Help
+		if help == "" {
+			help = jsonwalk.DefaultHelp
+		}
+		g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: metric.Name, Help: help}, labelNames)
+		if err := registry.Register(g); err != nil {
+			level.Warn(logger).Log("msg", "Skipping metric", "metric", metric.Name, "err", err)
+			walkErrorsTotal.Inc()
+			continue
+		}
+		for _, sample := range samples {
+			if indexed {
+				if _, ok := sample.labels["index"]; !ok {
+					sample.labels["index"] = ""
+				}
+			}
+			g.With(sample.labels).Set(sample.value)
+		}
+	}
+}
+
+var (
+	probesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "json_exporter_probes_total",
+		Help: "Total number of probes by result",
+	}, []string{"result"})
+	probeDurationHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "json_exporter_probe_duration_seconds",
+		Help: "Duration of probes in seconds",
+	})
+	walkErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "json_exporter_walk_errors_total",
+		Help: "Total number of values or metrics skipped because they could not be exported",
+	})
+	httpErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "json_exporter_http_errors_total",
+		Help: "Total number of requests to targets that failed or got an invalid status code, including retried ones",
+	})
+)
+
+func init() {
+	probesTotal.WithLabelValues("success")
+	probesTotal.WithLabelValues("failure")
+	prometheus.MustRegister(probesTotal, probeDurationHistogram, walkErrorsTotal, httpErrorsTotal, version.NewCollector("json_exporter"))
+}
+
+// probe requests target and registers the retrieved values into registry,
+// along with metrics describing the probe and the walk over the document.
+// probe_success and probe_duration_seconds are registered even when the
+// target cannot be probed, in which case the error is returned. The values
+// are exported with vecs, or with new vectors if it is nil.
+func probe(ctx context.Context, registry prometheus.Registerer, target string, module Module, vecs *walkVecs, logger log.Logger) error {
+	registry = prometheus.WrapRegistererWith(module.Labels, registry)
+
+	probeSuccessGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Whether the target was retrieved and parsed successfully",
+	})
+	probeDurationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "How long retrieving the target took in seconds",
+	})
+	statusCodeGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_http_status_code",
+		Help: "Status code of the target's response, 0 if none was received",
+	})
+	parseSuccessGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "json_parse_success",
+		Help: "Whether the target's response parsed, 0 if it was malformed",
+	})
+	if err := register(registry, probeSuccessGauge, probeDurationGauge, statusCodeGauge, parseSuccessGauge); err != nil {
+		return err
+	}
+
+	trace := &probeTrace{}
+	start := time.Now()
+	jsonData, resp, err := cachedProbeTarget(withProbeTrace(ctx, trace), target, module.Probe)
+	probeDurationGauge.Set(time.Since(start).Seconds())
+	phaseDurationGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_http_duration_seconds",
+		Help: "How long each phase of the request to the target took in seconds",
+	}, []string{"phase"})
+	durations := trace.durations()
+	for _, phase := range httpPhases {
+		phaseDurationGauge.WithLabelValues(phase).Set(durations[phase])
+	}
+	if err := register(registry, phaseDurationGauge); err != nil {
+		return err
+	}
+	retriesGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_retries",
+		Help: "How many times the request to the target was retried",
+	})
+	retriesGauge.Set(float64(trace.retryCount()))
+	redirectsGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_http_redirects",
+		Help: "How many redirects the request to the target followed",
+	})
+	redirectsGauge.Set(float64(trace.redirectCount()))
+	if err := register(registry, retriesGauge, redirectsGauge); err != nil {
+		return err
+	}
+	if resp != nil {
+		statusCodeGauge.Set(float64(resp.StatusCode))
+		contentLengthGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_http_content_length",
+			Help: "Length of the target's response body as sent, before decompression, -1 if unknown",
+		})
+		contentLengthGauge.Set(float64(resp.ContentLength))
+		if err := register(registry, contentLengthGauge); err != nil {
+			return err
+		}
+		// After redirects the response is for another URL than the target.
+		finalURLGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "probe_http_final_url_info",
+			Help:        "The URL of the target's response after following redirects",
+			ConstLabels: prometheus.Labels{"url": resp.Request.URL.Redacted()},
+		})
+		finalURLGauge.Set(1)
+		if err := register(registry, finalURLGauge); err != nil {
+			return err
+		}
+	}
+	var perr *parseError
+	if !errors.As(err, &perr) {
+		parseSuccessGauge.Set(1)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(module.LabelPaths) > 0 {
+		registry = prometheus.WrapRegistererWith(documentLabels(jsonData, module.LabelPaths), registry)
+	}
+
+	if len(module.Metrics) > 0 {
+		probeSuccessGauge.Set(1)
+		doSelectJSON(module.Metrics, jsonData, registry, module.Walk, logger)
+		return nil
+	}
+
+	jsonData, err = selectRoot(jsonData, module.Root)
+	if err != nil {
+		return err
+	}
+	probeSuccessGauge.Set(1)
+
+	if vecs == nil {
+		vecs = newWalkVecs()
+	}
+	stats := vecs.walkJSON(module.Prefix, jsonData, registry, module.Walk, logger)
+
+	maxDepthGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_max_depth",
+		Help: "Deepest nesting level reached while walking the retrieved document",
+	})
+	maxDepthGauge.Set(float64(stats.MaxDepth))
+	if err := register(registry, maxDepthGauge); err != nil {
+		return err
+	}
+
+	valueTypesCounter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_value_types",
+			Help: "Number of values of each JSON type encountered while walking the retrieved document",
+		},
+		[]string{"type"},
+	)
+	for _, t := range jsonwalk.ValueTypes {
+		valueTypesCounter.WithLabelValues(t).Add(float64(stats.ValueTypes[t]))
+	}
+	if err := register(registry, valueTypesCounter); err != nil {
+		return err
+	}
+
+	truncatedArraysCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "json_truncated_arrays_total",
+		Help: "Number of arrays truncated to the maximum array length while walking the retrieved document",
+	})
+	truncatedArraysCounter.Add(float64(stats.TruncatedArrays))
+	if err := register(registry, truncatedArraysCounter); err != nil {
+		return err
+	}
+
+	if stats.DepthLimited && module.Walk.FailOnMaxDepth {
+		probeSuccessGauge.Set(0)
+		return fmt.Errorf("document nested deeper than the maximum depth of %d", module.Walk.MaxDepth)
+	}
+	return nil
+}
+
+// register registers collectors with registry, returning the first error
+// rather than panicking, as a probe request must not crash the exporter.
+func register(registry prometheus.Registerer, collectors ...prometheus.Collector) error {
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// documentLabels returns the labels whose values labelPaths select from
+// jsonData, the first value matched by their JSONPath expression.
+func documentLabels(jsonData interface{}, labelPaths map[string]string) prometheus.Labels {
+	labels := prometheus.Labels{}
+	for name, expr := range labelPaths {
+		labels[name] = ""
+		path, err := parseJSONPath(expr)
+		if err != nil {
+			continue
+		}
+		if matches := path.Select(jsonData); len(matches) > 0 {
+			labels[name] = jsonwalk.LabelValue(matches[0].Value)
+		}
+	}
+	return labels
+}
+
+// selectRoot returns the subtree of jsonData at root, a path of object keys
+// and array indices separated by dots or "::". An empty root selects the
+// whole document.
+func selectRoot(jsonData interface{}, root string) (interface{}, error) {
+	if root == "" {
+		return jsonData, nil
+	}
+	separator := "."
+	if strings.Contains(root, "::") {
+		separator = "::"
+	}
+	value := jsonData
+	for _, key := range strings.Split(root, separator) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			x, ok := v[key]
+			if !ok {
+				return nil, fmt.Errorf("root %q not found: no key %q", root, key)
+			}
+			value = x
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("root %q not found: no index %q", root, key)
+			}
+			value = v[i]
+		default:
+			return nil, fmt.Errorf("root %q not found: %q is not in an object or array", root, key)
+		}
+	}
+	return value, nil
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseBody parses a request body as a template, in which json quotes a
+// value as a JSON string.
+func parseBody(body string) (*template.Template, error) {
+	return template.New("body").Option("missingkey=error").Funcs(template.FuncMap{
+		"json": func(s string) (string, error) {
+			b, err := json.Marshal(s)
+			return string(b), err
+		},
+	}).Parse(body)
+}
+
+// expandBody expands the body template with the first value of each query
+// parameter, e.g. {{ .index }} or {{ json .query }}. Referring to a missing
+// parameter is an error.
+func expandBody(body string, params url.Values) (string, error) {
+	if !strings.Contains(body, "{{") {
+		return body, nil
+	}
+	tmpl, err := parseBody(body)
+	if err != nil {
+		return "", fmt.Errorf("invalid body template: %v", err)
+	}
+	data := make(map[string]string, len(params))
+	for name := range params {
+		data[name] = params.Get(name)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("invalid body template: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// parseBoolParam sets dst from the named query parameter if it is present.
+func parseBoolParam(params url.Values, name string, dst *bool) error {
+	value := params.Get(name)
+	if value == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s parameter %q", name, value)
+	}
+	*dst = b
+	return nil
+}
+
+// applyParams overrides the settings of module with those given as query
+// parameters of a probe.
+func applyParams(module *Module, params url.Values) error {
+	if prefix := params.Get("prefix"); prefix != "" {
+		module.Prefix = prefix
+	}
+	if root := params.Get("root"); root != "" {
+		module.Root = root
+	}
+
+	if username := params.Get("username"); username != "" {
+		module.Probe.Username = username
+		module.Probe.Password = params.Get("password")
+	}
+	if token := params.Get("token"); token != "" {
+		module.Probe.BearerToken = token
+	}
+
+	if t := params.Get("timeout"); t != "" {
+		timeout, err := parseTimeout(t)
+		if err != nil {
+			return err
+		}
+		module.Probe.Timeout = timeout
+	}
+
+	if !module.AllowParamOverrides {
+		for _, name := range []string{"method", "body", "content_type", "export_strings", "insecure"} {
+			if params.Get(name) != "" {
+				return fmt.Errorf("parameter %q is not allowed by the module", name)
+			}
+		}
+	}
+	if method := params.Get("method"); method != "" {
+		module.Probe.Method = strings.ToUpper(method)
+	}
+	if body := params.Get("body"); body != "" {
+		module.Probe.Body = body
+	}
+	if contentType := params.Get("content_type"); contentType != "" {
+		module.Probe.ContentType = contentType
+	}
+	body, err := expandBody(module.Probe.Body, params)
+	if err != nil {
+		return err
+	}
+	module.Probe.Body = body
+	if format := params.Get("format"); format != "" {
+		if format != "json" && format != "xml" && format != "ndjson" {
+			return fmt.Errorf("invalid format parameter %q: expected json, xml or ndjson", format)
+		}
+		module.Probe.Format = format
+	}
+
+	if err := parseBoolParam(params, "insecure", &module.Probe.TLS.InsecureSkipVerify); err != nil {
+		return err
+	}
+
+	if err := parseBoolParam(params, "nocache", &module.Probe.NoCache); err != nil {
+		return err
+	}
+
+	if err := parseBoolParam(params, "parse_strings", &module.Walk.ParseNumericStrings); err != nil {
+		return err
+	}
+
+	if err := parseBoolParam(params, "parse_bools", &module.Walk.ParseBoolStrings); err != nil {
+		return err
+	}
+
+	if err := parseBoolParam(params, "skip_nonfinite", &module.Walk.SkipNonFinite); err != nil {
+		return err
+	}
+
+	if err := parseBoolParam(params, "export_strings", &module.Walk.ExportStrings); err != nil {
+		return err
+	}
+
+	if labelKeys := params.Get("label_keys"); labelKeys != "" {
+		module.Walk.LabelKeys = splitList(labelKeys)
+	}
+
+	if exprs := params["jsonpath"]; len(exprs) > 0 {
+		metrics := make([]MetricConfig, len(exprs))
+		for i, expr := range exprs {
+			j := strings.Index(expr, ":")
+			if j < 0 {
+				return fmt.Errorf("invalid jsonpath parameter %q: expected name:expression", expr)
+			}
+			metrics[i] = MetricConfig{Name: expr[:j], Path: expr[j+1:]}
+			if err := metrics[i].validate(); err != nil {
+				return fmt.Errorf("invalid jsonpath parameter %q: %v", expr, err)
+			}
+		}
+		module.Metrics = metrics
+	}
+
+	if labels := params["label"]; len(labels) > 0 {
+		merged := make(map[string]string, len(module.Labels)+len(labels))
+		for name, value := range module.Labels {
+			merged[name] = value
+		}
+		for _, label := range labels {
+			i := strings.Index(label, ":")
+			if i < 0 {
+				return fmt.Errorf("invalid label parameter %q: expected name:value", label)
+			}
+			merged[label[:i]] = label[i+1:]
+		}
+		module.Labels = merged
+	}
+
+	return module.checkLabels()
+}
+
+// unknownModuleError is returned by moduleFor for a module missing from the
+// configuration.
+type unknownModuleError string
+
+func (e unknownModuleError) Error() string {
+	return fmt.Sprintf("Unknown module %q", string(e))
+}
+
+// moduleFor returns the module selected by a probe request, with the
+// settings of its parameters and headers applied.
+func moduleFor(r *http.Request) (Module, error) {
+	params := r.URL.Query()
+
+	module := defaultModule
+	if name := params.Get("module"); name != "" {
+		var ok bool
+		module, ok = currentConfig().Modules[name]
+		if !ok {
+			return Module{}, unknownModuleError(name)
+		}
+	}
+
+	var missing []string
+	for _, name := range module.RequiredParams {
+		if params.Get(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return Module{}, fmt.Errorf("Missing required parameters: %s", strings.Join(missing, ", "))
+	}
+
+	if err := applyParams(&module, params); err != nil {
+		return Module{}, err
+	}
+	if module.Probe.ForwardAuthorization {
+		module.Probe.Authorization = r.Header.Get("Authorization")
+	}
+
+	if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+		scrapeTimeout, err := parseTimeout(header)
+		if err != nil {
+			return Module{}, fmt.Errorf("Invalid X-Prometheus-Scrape-Timeout-Seconds header: %v", err)
+		}
+		if scrapeTimeout > scrapeTimeoutOffset {
+			scrapeTimeout -= scrapeTimeoutOffset
+		}
+		if module.Probe.Timeout == 0 || scrapeTimeout < module.Probe.Timeout {
+			module.Probe.Timeout = scrapeTimeout
+		}
+	}
+	return module, nil
+}
+
+func probeHandler(w http.ResponseWriter, r *http.Request, logger log.Logger) {
 	params := r.URL.Query()
 
-	target := params.Get("target")
-	if target == "" {
+	targets := params["target"]
+	if len(targets) == 0 {
 		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
 		return
 	}
+	// A target repeated would register its metrics twice, so each is
+	// probed once.
+	seen := make(map[string]bool, len(targets))
+	var unique []string
+	for _, target := range targets {
+		if target == "" {
+			http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		if err := checkTarget(target); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if !seen[target] {
+			seen[target] = true
+			unique = append(unique, target)
+		}
+	}
+	targets = unique
 
-	prefix := params.Get("prefix")
-
-	jsonData, err := doProbe(httpClient, target)
+	if name := params.Get("module"); name != "" {
+		logger = log.With(logger, "module", name)
+	}
+	module, err := moduleFor(r)
+	var unknown unknownModuleError
+	if errors.As(err, &unknown) {
+		// Report a failed probe rather than fail the scrape, so that a
+		// mistyped module shows as a target down for a reason.
+		level.Warn(logger).Log("msg", "Probe failed", "err", err)
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "probe_success",
+			Help:        "Whether the target was retrieved and parsed successfully",
+			ConstLabels: prometheus.Labels{"reason": "unknown_module"},
+		}))
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(w, r)
+		return
+	}
 	if err != nil {
-		log.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	// log.Printf("Retrieved value %v", jsonData)
 
-	registry := prometheus.NewRegistry()
+	_, labeled := module.Labels["target"]
+	if _, ok := module.LabelPaths["target"]; ok {
+		labeled = true
+	}
+	if labeled && len(targets) > 1 {
+		http.Error(w, `Label "target" clashes with the label of multiple targets`, http.StatusBadRequest)
+		return
+	}
+
+	release, ok := acquireProbeSlot(r.Context())
+	if !ok {
+		level.Warn(logger).Log("msg", "Too many concurrent probes, rejecting request", "max_concurrent_probes", cap(probeSlots))
+		http.Error(w, "Too many concurrent probes", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
 
-	doWalkJSON(prefix, jsonData, registry)
+	// The kept vectors of each target are released once the response is
+	// written, as gathering the metrics reads them.
+	vecs := make([]*walkVecs, len(targets))
+	for i, target := range targets {
+		var release func()
+		vecs[i], release = acquireWalkVecs(target, params.Get("module"))
+		defer release()
+	}
 
-	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	registry := prometheus.NewRegistry()
+	if len(targets) == 1 {
+		runProbe(r.Context(), registry, targets[0], module, vecs[0], logger)
+	} else {
+		// Probe the targets concurrently into one registry, telling their
+		// metrics apart with a target label.
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, targetConcurrency)
+		for i, target := range targets {
+			wg.Add(1)
+			go func(target string, vecs *walkVecs) {
+				defer wg.Done()
+				slots <- struct{}{}
+				defer func() { <-slots }()
+				targetRegistry := prometheus.WrapRegistererWith(prometheus.Labels{"target": target}, registry)
+				runProbe(r.Context(), targetRegistry, target, module, vecs, logger)
+			}(target, vecs[i])
+		}
+		wg.Wait()
+	}
+
+	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
 	h.ServeHTTP(w, r)
 }
 
-var indexHTML = []byte(`<html>
-<head><title>Json Exporter</title></head>
-<body>
-<h1>Json Exporter</h1>
-<p><a href="/probe">Run a probe</a></p>
-<p><a href="/metrics">Metrics</a></p>
-</body>
-</html>`)
+// targetConcurrency bounds how many of the targets of a request are probed
+// at the same time.
+var targetConcurrency = 4
+
+// runProbe probes target, logging failures and counting probes in the
+// exporter's own metrics.
+func runProbe(ctx context.Context, registry prometheus.Registerer, target string, module Module, vecs *walkVecs, logger log.Logger) {
+	logger = log.With(logger, "target", target)
+	start := time.Now()
+	err := probe(ctx, registry, target, module, vecs, logger)
+	probeDurationHistogram.Observe(time.Since(start).Seconds())
+	if err != nil {
+		level.Error(logger).Log("msg", "Probe failed", "err", err)
+		probesTotal.WithLabelValues("failure").Inc()
+	} else {
+		probesTotal.WithLabelValues("success").Inc()
+	}
+}
 
 func main() {
 	addr := flag.String("listen-address", ":9116", "The address to listen on for HTTP requests.")
+	webConfigFile := flag.String("web.config.file", "", "A web configuration file enabling TLS or basic auth on the exporter's own endpoints, see https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md.")
+	probePath := flag.String("web.probe-path", "/probe", "The path under which to serve probes.")
+	telemetryPath := flag.String("web.telemetry-path", "/metrics", "The path under which to expose the exporter's own metrics.")
+	flag.IntVar(&targetConcurrency, "target-concurrency", targetConcurrency, "How many targets of a probe request to probe at the same time.")
+	maxConcurrentProbes := flag.Int("max-concurrent-probes", 0, "How many probe requests to serve at the same time. 0 means no limit.")
+	flag.DurationVar(&probeQueueTimeout, "probe-queue-timeout", probeQueueTimeout, "How long a probe request waits for -max-concurrent-probes before failing with a 503.")
+	flag.BoolVar(&reuseVecs, "reuse-metric-vecs", false, "Keep the metric vectors of each target between probes, resetting them instead of building them anew.")
+	flag.IntVar(&maxKeptVecs, "reuse-metric-vecs-max-targets", maxKeptVecs, "How many targets to keep metric vectors for at most with -reuse-metric-vecs, dropping those probed least recently. 0 means no limit.")
+	flag.DurationVar(&scrapeTimeoutOffset, "scrape-timeout-offset", scrapeTimeoutOffset, "How much shorter than the scrape timeout sent by Prometheus probes time out, leaving time to respond.")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "Reuse documents retrieved from a target for this long. 0 disables caching.")
+	flag.IntVar(&cacheMaxEntries, "cache-max-entries", cacheMaxEntries, "How many retrieved documents to cache at most, dropping those expiring first. 0 means no limit.")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for probes in flight when shutting down.")
+	configFile := flag.String("config.file", "", "A YAML file defining the modules probes may select.")
+	flag.StringVar(&defaultModule.Root, "root", "", "The path of the subtree of documents to walk, e.g. data.metrics. Empty means the whole document.")
+	flag.BoolVar(&defaultModule.Walk.ParseNumericStrings, "parse-numeric-strings", false, "Export string values that parse as numbers.")
+	flag.Var(&defaultModule.Walk.NumericStringPath, "numeric-string-path", "Export string values that parse as numbers when their path matches this regular expression.")
+	flag.StringVar(&defaultModule.Walk.Separator, "name-separator", jsonwalk.DefaultSeparator, "The separator joining path segments in metric names.")
+	flag.BoolVar(&defaultModule.Walk.ParseBoolStrings, "parse-bool-strings", false, "Export strings like \"true\", \"no\" or \"up\" as 1 or 0.")
+	flag.BoolVar(&defaultModule.Walk.LowercaseNames, "lowercase-names", false, "Lowercase the metric names built from paths.")
+	flag.BoolVar(&defaultModule.Walk.ReplaceColons, "replace-colons", false, "Replace the colons of the metric names built from paths, including the :: separator, with underscores.")
+	flag.BoolVar(&defaultModule.Walk.SkipNonFinite, "skip-nonfinite", false, "Skip NaN and infinite values instead of exporting them.")
+	flag.IntVar(&defaultModule.Walk.MaxDepth, "max-depth", 0, "Skip values nested deeper than this many levels. 0 means no limit.")
+	flag.BoolVar(&defaultModule.Walk.FailOnMaxDepth, "fail-on-max-depth", false, "Fail probes of documents nested deeper than -max-depth instead of only skipping the deeper values.")
+	flag.IntVar(&defaultModule.Walk.FlattenDepth, "flatten-depth", 0, "Label values nested deeper than this many levels with their keys instead of naming metrics after them. 0 means no limit.")
+	flag.IntVar(&defaultModule.Walk.MaxArrayLength, "max-array-length", 0, "Only export the first elements of arrays longer than this. 0 means no limit.")
+	flag.BoolVar(&defaultModule.Walk.ParseTimestamps, "parse-timestamps", false, "Export RFC3339 timestamp strings as unix seconds.")
+	flag.StringVar(&defaultModule.Walk.TimestampLayout, "timestamp-layout", "", "The Go time layout of timestamps for -parse-timestamps, RFC3339 if empty.")
+	flag.StringVar(&defaultModule.Walk.TimestampKey, "timestamp-key", "", "A key holding the time the other values of its object were measured at, exported as their timestamp.")
+	flag.BoolVar(&defaultModule.Walk.AggregateArrays, "aggregate-arrays", false, "Export arrays of numbers as their count, sum, min, max and avg instead of one series per element.")
+	flag.BoolVar(&defaultModule.Walk.ExportStrings, "export-strings", false, "Export other string values as metrics of value 1 labeled with the string.")
+	flag.BoolVar(&defaultModule.Walk.TrimStrings, "trim-strings", false, "Trim the white space around strings exported by -export-strings, skipping blank ones.")
+	flag.BoolVar(&defaultModule.Walk.SkipBlankStrings, "skip-blank-strings", false, "Skip strings holding only white space with -export-strings, exporting others untrimmed.")
+	flag.BoolVar(&defaultModule.Walk.FlattenSingletons, "flatten-singletons", false, "Export the element of single-element arrays as if it were in place of the array.")
+	flag.BoolVar(&defaultModule.Walk.PathIndexLabels, "path-index-labels", false, "Prefix array index labels with the path of their array, e.g. x_array_0_index.")
+	flag.Var(&defaultModule.Walk.IncludePath, "include-path", "Only export values whose path matches this regular expression.")
+	flag.Var(&defaultModule.Walk.ExcludePath, "exclude-path", "Skip values whose path matches this regular expression.")
+	labelKeys := flag.String("label-keys", "", "Comma separated keys whose string values label the objects of an array instead of their index.")
+	flag.Int64Var(&defaultModule.Probe.MaxBodyBytes, "max-body-bytes", defaultMaxBodyBytes, "The maximum size of a target's response body in bytes.")
+	flag.IntVar(&defaultModule.Probe.MaxRetries, "max-retries", 0, "How many times to retry requests failing with a network error or a 502, 503 or 504 status.")
+	flag.DurationVar(&defaultModule.Probe.RetryBaseDelay, "retry-base-delay", 100*time.Millisecond, "The delay before the first retry, doubled for each retry after.")
+	flag.BoolVar(&defaultModule.Probe.IgnoreContentType, "ignore-content-type", false, "Parse responses as JSON whatever their Content-Type.")
+	flag.StringVar(&defaultModule.Probe.ProxyURL, "proxy-url", "", "The http, https or socks5 URL of a proxy to probe targets through, overriding HTTP_PROXY and HTTPS_PROXY.")
+	flag.BoolVar(&defaultModule.Probe.FollowRedirects, "follow-redirects", true, "Follow redirects of targets.")
+	flag.IntVar(&defaultModule.Probe.MaxRedirects, "max-redirects", defaultMaxRedirects, "How many redirects of a target to follow before failing the probe.")
+	flag.BoolVar(&defaultModule.Probe.ForwardAuthorization, "forward-authorization", false, "Send the Authorization header of probe requests to targets without credentials. Cannot be set along with -web.config.file.")
+	flag.BoolVar(&defaultModule.Probe.TLS.InsecureSkipVerify, "tls-insecure-skip-verify", false, "Skip verifying the TLS certificates of all targets.")
+	flag.StringVar(&defaultModule.Probe.BearerTokenFile, "auth-token-file", "", "A file holding a bearer token to send to all targets, re-read on every probe.")
+	flag.StringVar(&defaultModule.Probe.PasswordFile, "auth-password-file", "", "A file holding the basic auth password for the username parameter, re-read on every probe.")
+	flag.StringVar(&defaultModule.Probe.TLS.CAFile, "tls-ca-file", "", "A PEM bundle of CA certificates to verify targets against.")
+	flag.StringVar(&defaultModule.Probe.TLS.CertFile, "tls-cert-file", "", "A PEM client certificate to present to targets, with -tls-key-file.")
+	flag.StringVar(&defaultModule.Probe.TLS.KeyFile, "tls-key-file", "", "The PEM key of -tls-cert-file.")
+	flag.StringVar(&defaultModule.Probe.TLS.ServerName, "tls-server-name", "", "The name to verify target certificates against instead of their host.")
+	flag.StringVar(&defaultModule.Probe.TLS.MinVersion, "tls-min-version", "", "The oldest TLS version to accept: TLS10, TLS11, TLS12 or TLS13.")
+	flag.Var(&allowedTargets, "allowed-targets", "Only probe targets matching this regular expression, e.g. ^https://[^/]*\\.example\\.com/.")
+	allowedNetworksList := flag.String("allowed-networks", "", "Comma separated CIDR networks, e.g. 10.1.0.0/16, that are the only ones targets may be requested from.")
+	flag.BoolVar(&blockPrivateNetworks, "block-private-networks", false, "Refuse to request targets at loopback, private and link-local addresses outside -allowed-networks.")
+	flag.BoolVar(&allowUnixTargets, "allow-unix-targets", false, "Allow unix:// targets, requested over a unix domain socket.")
+	flag.BoolVar(&defaultModule.AllowParamOverrides, "allow-param-overrides", false, "Let the method, body, content_type, export_strings and insecure parameters of probes without a module override the request sent to targets, the strings exported and certificate verification.")
+	allowedFileDirsList := flag.String("allowed-file-dirs", "", "Comma separated absolute directories, e.g. /var/lib/app, that are the only ones file:// targets may be read from. Unset refuses file:// targets.")
+	textfileOutput := flag.String("textfile.output", "", "Write metrics to this file for the node_exporter textfile collector instead of serving HTTP.")
+	textfileTarget := flag.String("textfile.target", "", "The target to probe when -textfile.output is set.")
+	textfilePrefix := flag.String("textfile.prefix", "", "The metric name prefix to use when -textfile.output is set.")
+	textfileInterval := flag.Duration("textfile.interval", time.Minute, "How often to probe the target when -textfile.output is set.")
+	promlogConfig := &promlog.Config{Level: &promlog.AllowedLevel{}, Format: &promlog.AllowedFormat{}}
+	promlogConfig.Level.Set("info")
+	promlogConfig.Format.Set("logfmt")
+	flag.Var(promlogConfig.Level, "log.level", "Only log messages with the given severity or above. One of: [debug, info, warn, error]")
+	flag.Var(promlogConfig.Format, "log.format", "Output format of log messages. One of: [logfmt, json]")
+	printVersion := flag.Bool("version", false, "Print version information and exit.")
 	flag.Parse()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write(indexHTML)
-	})
-	http.HandleFunc("/probe", probeHandler)
-	http.Handle("/metrics", promhttp.Handler())
+	if *printVersion {
+		fmt.Println(version.Print("json_exporter"))
+		return
+	}
+
+	logger := promlog.New(promlogConfig)
+	level.Info(logger).Log("msg", "Starting json_exporter", "version", version.Info())
+	level.Info(logger).Log("build_context", version.BuildContext())
 
-	log.Printf("listenning on %s", *addr)
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	defaultModule.Walk.LabelKeys = splitList(*labelKeys)
+	if *allowedNetworksList != "" {
+		networks, err := parseCIDRs(splitList(*allowedNetworksList))
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid flags", "err", fmt.Sprintf("-allowed-networks: %v", err))
+			os.Exit(1)
+		}
+		allowedNetworks = networks
+	}
+	if *allowedFileDirsList != "" {
+		dirs, err := parseFileDirs(splitList(*allowedFileDirsList))
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid flags", "err", fmt.Sprintf("-allowed-file-dirs: %v", err))
+			os.Exit(1)
+		}
+		allowedFileDirs = dirs
+	}
+
+	webConfigured = *webConfigFile != ""
+	if err := defaultModule.validate(); err != nil {
+		level.Error(logger).Log("msg", "Invalid flags", "err", err)
+		os.Exit(1)
+	}
+	if targetConcurrency < 1 {
+		level.Error(logger).Log("msg", "Invalid flags", "err", "-target-concurrency must be at least 1")
+		os.Exit(1)
+	}
+	if scrapeTimeoutOffset < 0 {
+		level.Error(logger).Log("msg", "Invalid flags", "err", "-scrape-timeout-offset must not be negative")
+		os.Exit(1)
+	}
+	if *maxConcurrentProbes < 0 {
+		level.Error(logger).Log("msg", "Invalid flags", "err", "-max-concurrent-probes must not be negative")
+		os.Exit(1)
+	}
+	if *textfileInterval <= 0 {
+		level.Error(logger).Log("msg", "Invalid flags", "err", "-textfile.interval must be positive")
+		os.Exit(1)
+	}
+	if !strings.HasPrefix(*probePath, "/") || !strings.HasPrefix(*telemetryPath, "/") || *probePath == *telemetryPath {
+		level.Error(logger).Log("msg", "Invalid flags", "err", "-web.probe-path and -web.telemetry-path must be different paths starting with /")
+		os.Exit(1)
+	}
+	if *maxConcurrentProbes > 0 {
+		probeSlots = make(chan struct{}, *maxConcurrentProbes)
+	}
+
+	// Serve before loading the configuration, reporting not ready until it
+	// is loaded.
+	reload := func() error {
+		if *configFile == "" {
+			return errors.New("no -config.file to reload")
+		}
+		return reloadConfig(*configFile, logger)
+	}
+	server := &http.Server{Addr: *addr, Handler: newServeMux(*probePath, *telemetryPath, reload, logger)}
+	if *textfileOutput == "" {
+		go func() {
+			flags := &web.FlagConfig{WebListenAddresses: &[]string{*addr}, WebConfigFile: webConfigFile}
+			if err := web.ListenAndServe(server, flags, logger); err != http.ErrServerClosed {
+				level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if *configFile != "" {
+		if err := reloadConfig(*configFile, logger); err != nil {
+			os.Exit(1)
+		}
+	}
+	setReady(true)
+
+	// Reload the configuration on SIGHUP, keeping the current one if the
+	// file is invalid.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload()
+		}
+	}()
+
+	if *textfileOutput != "" {
+		if *textfileTarget == "" {
+			level.Error(logger).Log("msg", "-textfile.target is required with -textfile.output")
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Writing metrics to textfile", "target", *textfileTarget, "output", *textfileOutput, "interval", *textfileInterval)
+		module := defaultModule
+		module.Prefix = *textfilePrefix
+		runTextfile(*textfileTarget, module, *textfileOutput, *textfileInterval, logger)
+		return
+	}
+
+	// Stop accepting connections on termination, but let probes in flight
+	// finish so that rolling updates do not fail scrapes.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	level.Info(logger).Log("msg", "Shutting down", "signal", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		level.Error(logger).Log("msg", "Error shutting down", "err", err)
+	}
 }
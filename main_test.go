@@ -1,12 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
+
+	"github.com/shiroyagicorp/prometheus-json-exporter/pkg/jsonwalk"
 )
 
 func refString(s string) *string {
@@ -25,6 +53,7 @@ func TestWalkJSON(t *testing.T) {
 	testData := []struct {
 		name     string
 		bytes    []byte
+		opts     jsonwalk.Options
 		expected []*dto.MetricFamily
 	}{
 		{
@@ -86,6 +115,74 @@ func TestWalkJSON(t *testing.T) {
 			bytes:    []byte(`{"x": "ok"}`),
 			expected: nil,
 		},
+		{
+			name:  "numeric string value",
+			bytes: []byte(`{"x": " 21.5"}`),
+			opts:  jsonwalk.Options{ParseNumericStrings: true},
+			expected: []*dto.MetricFamily{
+				&dto.MetricFamily{
+					Name: refString("x"),
+					Help: refString("Retrieved value"),
+					Type: refMetricType(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{
+						&dto.Metric{
+							Gauge: &dto.Gauge{
+								Value: refFloat64(21.5),
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:     "numeric string value without parsing",
+			bytes:    []byte(`{"x": "21.5"}`),
+			expected: nil,
+		},
+		{
+			name:     "non-numeric string value with parsing",
+			bytes:    []byte(`{"x": "ok"}`),
+			opts:     jsonwalk.Options{ParseNumericStrings: true},
+			expected: nil,
+		},
+		{
+			name:  "non-finite values",
+			bytes: []byte(`{"x": "1e400", "y": "NaN", "z": 1}`),
+			opts:  jsonwalk.Options{ParseNumericStrings: true, SkipNonFinite: true},
+			expected: []*dto.MetricFamily{
+				&dto.MetricFamily{
+					Name: refString("z"),
+					Help: refString("Retrieved value"),
+					Type: refMetricType(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{
+						&dto.Metric{
+							Gauge: &dto.Gauge{
+								Value: refFloat64(1.0),
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:  "non-finite value without skipping",
+			bytes: []byte(`{"x": "-1e400"}`),
+			opts:  jsonwalk.Options{ParseNumericStrings: true},
+			expected: []*dto.MetricFamily{
+				&dto.MetricFamily{
+					Name: refString("x"),
+					Help: refString("Retrieved value"),
+					Type: refMetricType(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{
+						&dto.Metric{
+							Gauge: &dto.Gauge{
+								Value: refFloat64(math.Inf(-1)),
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			name:     "null value",
 			bytes:    []byte(`{"x": null}`),
@@ -292,6 +389,146 @@ func TestWalkJSON(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:  "custom separator",
+			bytes: []byte(`{"x": {"y": [1]}}`),
+			opts:  jsonwalk.Options{Separator: "_"},
+			expected: []*dto.MetricFamily{
+				&dto.MetricFamily{
+					Name: refString("x_y_array_0"),
+					Help: refString("Retrieved value"),
+					Type: refMetricType(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{
+						&dto.Metric{
+							Label: []*dto.LabelPair{
+								&dto.LabelPair{
+									Name:  refString("array_0_index"),
+									Value: refString("0"),
+								},
+							},
+							Gauge: &dto.Gauge{
+								Value: refFloat64(1.0),
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:  "invalid characters in keys",
+			bytes: []byte(`{"cpu-usage.avg": 1, "2xx_count": 2}`),
+			expected: []*dto.MetricFamily{
+				&dto.MetricFamily{
+					Name: refString("_2xx_count"),
+					Help: refString("Retrieved value"),
+					Type: refMetricType(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{
+						&dto.Metric{
+							Gauge: &dto.Gauge{
+								Value: refFloat64(2.0),
+							},
+						},
+					},
+				},
+				&dto.MetricFamily{
+					Name: refString("cpu_usage_avg"),
+					Help: refString("Retrieved value"),
+					Type: refMetricType(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{
+						&dto.Metric{
+							Gauge: &dto.Gauge{
+								Value: refFloat64(1.0),
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:  "label keys in array of objects",
+			bytes: []byte(`{"disks": [{"name": "sda", "used": 10}, {"name": "sdb", "used": 20}, {"used": 30}]}`),
+			opts:  jsonwalk.Options{LabelKeys: []string{"id", "name"}},
+			expected: []*dto.MetricFamily{
+				&dto.MetricFamily{
+					Name: refString("disks::array_0::used"),
+					Help: refString("Retrieved value"),
+					Type: refMetricType(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{
+						&dto.Metric{
+							Label: []*dto.LabelPair{
+								&dto.LabelPair{
+									Name:  refString("array_0_index"),
+									Value: refString("2"),
+								},
+							},
+							Gauge: &dto.Gauge{
+								Value: refFloat64(30.0),
+							},
+						},
+					},
+				},
+				&dto.MetricFamily{
+					Name: refString("disks::used"),
+					Help: refString("Retrieved value"),
+					Type: refMetricType(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{
+						&dto.Metric{
+							Label: []*dto.LabelPair{
+								&dto.LabelPair{
+									Name:  refString("name"),
+									Value: refString("sda"),
+								},
+							},
+							Gauge: &dto.Gauge{
+								Value: refFloat64(10.0),
+							},
+						},
+						&dto.Metric{
+							Label: []*dto.LabelPair{
+								&dto.LabelPair{
+									Name:  refString("name"),
+									Value: refString("sdb"),
+								},
+							},
+							Gauge: &dto.Gauge{
+								Value: refFloat64(20.0),
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:  "max depth",
+			bytes: []byte(`{"x": 1, "y": {"z": 2, "w": {"v": 3}}, "u": [[4]]}`),
+			opts:  jsonwalk.Options{MaxDepth: 2},
+			expected: []*dto.MetricFamily{
+				&dto.MetricFamily{
+					Name: refString("x"),
+					Help: refString("Retrieved value"),
+					Type: refMetricType(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{
+						&dto.Metric{
+							Gauge: &dto.Gauge{
+								Value: refFloat64(1.0),
+							},
+						},
+					},
+				},
+				&dto.MetricFamily{
+					Name: refString("y::z"),
+					Help: refString("Retrieved value"),
+					Type: refMetricType(dto.MetricType_GAUGE),
+					Metric: []*dto.Metric{
+						&dto.Metric{
+							Gauge: &dto.Gauge{
+								Value: refFloat64(2.0),
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			name:  "array at root",
 			bytes: []byte(`[1, 2, 3]`),
@@ -350,7 +587,7 @@ func TestWalkJSON(t *testing.T) {
 
 			registry := prometheus.NewRegistry()
 
-			doWalkJSON("", jsonData, registry)
+			doWalkJSON("", jsonData, registry, tt.opts, log.NewNopLogger())
 			actual, err := registry.Gather()
 			if err != nil {
 				t.Errorf("Error: %v", err)
@@ -361,3 +598,2135 @@ func TestWalkJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestWalkJSONTimestamps(t *testing.T) {
+	testData := []struct {
+		name     string
+		bytes    []byte
+		opts     jsonwalk.Options
+		expected []float64
+	}{
+		{
+			name:     "RFC3339",
+			bytes:    []byte(`{"x": "2024-01-02T15:04:05Z"}`),
+			opts:     jsonwalk.Options{ParseTimestamps: true},
+			expected: []float64{1704207845},
+		},
+		{
+			name:     "RFC3339 with offset and fraction",
+			bytes:    []byte(`{"x": "2024-01-02T16:04:05.5+01:00"}`),
+			opts:     jsonwalk.Options{ParseTimestamps: true},
+			expected: []float64{1704207845},
+		},
+		{
+			name:     "custom layout",
+			bytes:    []byte(`{"x": "2024-01-02 15:04:05"}`),
+			opts:     jsonwalk.Options{ParseTimestamps: true, TimestampLayout: "2006-01-02 15:04:05"},
+			expected: []float64{1704207845},
+		},
+		{
+			name:     "not a timestamp",
+			bytes:    []byte(`{"x": "yesterday"}`),
+			opts:     jsonwalk.Options{ParseTimestamps: true},
+			expected: nil,
+		},
+		{
+			name:     "without parsing",
+			bytes:    []byte(`{"x": "2024-01-02T15:04:05Z"}`),
+			expected: nil,
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var jsonData interface{}
+			err := json.Unmarshal(tt.bytes, &jsonData)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+
+			registry := prometheus.NewRegistry()
+			doWalkJSON("", jsonData, registry, tt.opts, log.NewNopLogger())
+			families, err := registry.Gather()
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			var actual []float64
+			for _, family := range families {
+				for _, metric := range family.Metric {
+					actual = append(actual, metric.GetGauge().GetValue())
+				}
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDoWalkJSONTimestampKey(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{
+		"generated_at": "2024-01-02T15:04:05Z",
+		"total": 3,
+		"nodes": [
+			{"ts": 1704207900.5, "cpu": 1},
+			{"ts": "invalid", "cpu": 2}
+		],
+		"counts": {"requests": 10}
+	}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	opts := jsonwalk.Options{TimestampKey: "ts", MetricTypes: []jsonwalk.MetricTypeRule{{Type: "counter"}}}
+	opts.MetricTypes[0].Path.Set("requests$")
+	registry := prometheus.NewRegistry()
+	doWalkJSON("", jsonData, registry, opts, log.NewNopLogger())
+	opts.TimestampKey = "generated_at"
+	other := prometheus.NewRegistry()
+	doWalkJSON("", jsonData, other, opts, log.NewNopLogger())
+
+	testData := []struct {
+		name     string
+		registry *prometheus.Registry
+		expected map[string]int64
+	}{
+		{
+			name:     "per object",
+			registry: registry,
+			expected: map[string]int64{
+				"counts::requests":       0,
+				"nodes::array_0::cpu{0}": 1704207900500,
+				"nodes::array_0::cpu{1}": 0,
+				"total":                  0,
+			},
+		},
+		{
+			name:     "whole document",
+			registry: other,
+			expected: map[string]int64{
+				"counts::requests":       1704207845000,
+				"nodes::array_0::cpu{0}": 1704207845000,
+				"nodes::array_0::cpu{1}": 1704207845000,
+				"nodes::array_0::ts{0}":  1704207845000,
+				"total":                  1704207845000,
+			},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			families, err := tt.registry.Gather()
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			actual := map[string]int64{}
+			for _, family := range families {
+				for _, metric := range family.Metric {
+					name := family.GetName()
+					for _, label := range metric.Label {
+						name += "{" + label.GetValue() + "}"
+					}
+					actual[name] = metric.GetTimestampMs()
+				}
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkJSONMaxDepth(t *testing.T) {
+	testData := []struct {
+		name     string
+		bytes    []byte
+		expected int
+	}{
+		{name: "scalar at root", bytes: []byte(`"ok"`), expected: 0},
+		{name: "flat object", bytes: []byte(`{"x": 1, "y": 2}`), expected: 1},
+		{name: "nested object", bytes: []byte(`{"x": {"y": {"z": 1}}, "w": 1}`), expected: 3},
+		{name: "array in array", bytes: []byte(`{"x": [[1, 2], [3, 4]]}`), expected: 3},
+		{name: "empty object", bytes: []byte(`{"x": {}}`), expected: 1},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var jsonData interface{}
+			err := json.Unmarshal(tt.bytes, &jsonData)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+
+			stats := doWalkJSON("", jsonData, prometheus.NewRegistry(), jsonwalk.Options{}, log.NewNopLogger())
+			if stats.MaxDepth != tt.expected {
+				t.Errorf("Got: %d, expected: %d", stats.MaxDepth, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerFailOnMaxDepth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1, "y": {"z": {"w": 2}}}`))
+	}))
+	defer server.Close()
+
+	defer func(m Module) { defaultModule = m }(defaultModule)
+	defaultModule.Walk.MaxDepth = 2
+
+	testData := []struct {
+		name           string
+		failOnMaxDepth bool
+		expected       string
+	}{
+		{name: "skipped", failOnMaxDepth: false, expected: "probe_success 1\n"},
+		{name: "failed", failOnMaxDepth: true, expected: "probe_success 0\n"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultModule.Walk.FailOnMaxDepth = tt.failOnMaxDepth
+			rec := httptest.NewRecorder()
+			probeHandler(rec, httptest.NewRequest("GET", "/probe?target="+server.URL, nil), log.NewNopLogger())
+
+			body := rec.Body.String()
+			if !strings.Contains(body, tt.expected) {
+				t.Errorf("Got: %s, expected to contain: %s", body, tt.expected)
+			}
+			if strings.Contains(body, "y::z::w") {
+				t.Errorf("Got: %s, expected the deeper value to be skipped", body)
+			}
+		})
+	}
+}
+
+func TestDoWalkJSONPathFilters(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"status": {"ok": {"count": 1, "bytes": 2}, "error": {"count": 3}}, "uptime": 4}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	testData := []struct {
+		name     string
+		include  string
+		exclude  string
+		expected []string
+	}{
+		{name: "no filters", expected: []string{"status::error::count", "status::ok::bytes", "status::ok::count", "uptime"}},
+		{name: "include", include: "^status::.*::count$", expected: []string{"status::error::count", "status::ok::count"}},
+		{name: "exclude", exclude: "::ok::", expected: []string{"status::error::count", "uptime"}},
+		{name: "include and exclude", include: "count", exclude: "error", expected: []string{"status::ok::count"}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts jsonwalk.Options
+			if tt.include != "" {
+				opts.IncludePath.Set(tt.include)
+			}
+			if tt.exclude != "" {
+				opts.ExcludePath.Set(tt.exclude)
+			}
+
+			registry := prometheus.NewRegistry()
+			doWalkJSON("", jsonData, registry, opts, log.NewNopLogger())
+			families, err := registry.Gather()
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			var names []string
+			for _, family := range families {
+				names = append(names, family.GetName())
+			}
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", names, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDoWalkJSONExpectedPaths(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"status": {"ok": 1}, "errors": [2]}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	zero := 0.0
+	testData := []struct {
+		name     string
+		opts     jsonwalk.Options
+		expected string
+	}{
+		{
+			name: "missing path as NaN",
+			opts: jsonwalk.Options{ExpectedPaths: []string{"status::ok", "status::failed", "errors::array_0"}},
+			expected: `# HELP errors::array_0 Retrieved value
+# TYPE errors::array_0 gauge
+errors::array_0{array_0_index="0"} 2
+# HELP status::failed Retrieved value
+# TYPE status::failed gauge
+status::failed NaN
+# HELP status::ok Retrieved value
+# TYPE status::ok gauge
+status::ok 1
+`,
+		},
+		{
+			name: "missing path with value",
+			opts: jsonwalk.Options{ExpectedPaths: []string{"status::failed"}, MissingValue: &zero},
+			expected: `# HELP errors::array_0 Retrieved value
+# TYPE errors::array_0 gauge
+errors::array_0{array_0_index="0"} 2
+# HELP status::failed Retrieved value
+# TYPE status::failed gauge
+status::failed 0
+# HELP status::ok Retrieved value
+# TYPE status::ok gauge
+status::ok 1
+`,
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			doWalkJSON("", jsonData, registry, tt.opts, log.NewNopLogger())
+			if err := testutil.GatherAndCompare(registry, strings.NewReader(tt.expected)); err != nil {
+				t.Errorf("Error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDoWalkJSONMetricTypes(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"requests_total": 12, "bytes_sent": 34, "in_flight": 5, "errors_total": -1, "load": [0.5, -2]}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	var opts jsonwalk.Options
+	rules := []jsonwalk.MetricTypeRule{{Type: "counter"}, {Type: "counter"}, {Type: "untyped"}}
+	rules[0].Path.Set("_total$")
+	rules[1].Path.Set("^bytes_")
+	rules[2].Path.Set("^load")
+	opts.MetricTypes = rules
+
+	registry := prometheus.NewRegistry()
+	doWalkJSON("", jsonData, registry, opts, log.NewNopLogger())
+	families, err := registry.Gather()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	actual := map[string]dto.MetricType{}
+	for _, family := range families {
+		actual[family.GetName()] = family.GetType()
+		if family.GetName() == "requests_total" && family.Metric[0].GetCounter().GetValue() != 12 {
+			t.Errorf("Got: %v, expected: 12", family.Metric[0].GetCounter().GetValue())
+		}
+		if family.GetName() == "load::array_0" {
+			var values []float64
+			for _, metric := range family.Metric {
+				values = append(values, metric.GetUntyped().GetValue())
+			}
+			if !reflect.DeepEqual(values, []float64{0.5, -2}) {
+				t.Errorf("Got: %v, expected: %v", values, []float64{0.5, -2})
+			}
+		}
+	}
+	expected := map[string]dto.MetricType{
+		"bytes_sent":     dto.MetricType_COUNTER,
+		"in_flight":      dto.MetricType_GAUGE,
+		"load::array_0":  dto.MetricType_UNTYPED,
+		"requests_total": dto.MetricType_COUNTER,
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got: %v, expected: %v", actual, expected)
+	}
+}
+
+func TestDoWalkJSONHistogram(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"servers": [{"name": "a", "latencies": [0.2, 0.7, 3]}, {"name": "b", "latencies": [0.1]}]}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	opts := jsonwalk.Options{LabelKeys: []string{"name"}, Separator: "_"}
+	opts.MetricTypes = []jsonwalk.MetricTypeRule{{Type: "histogram", Buckets: []float64{0.5, 1}}}
+	opts.MetricTypes[0].Path.Set("_latencies$")
+
+	registry := prometheus.NewRegistry()
+	doWalkJSON("", jsonData, registry, opts, log.NewNopLogger())
+	expected := `# HELP servers_latencies Retrieved value
+# TYPE servers_latencies histogram
+servers_latencies_bucket{name="a",le="0.5"} 1
+servers_latencies_bucket{name="a",le="1"} 2
+servers_latencies_bucket{name="a",le="+Inf"} 3
+servers_latencies_sum{name="a"} 3.9
+servers_latencies_count{name="a"} 3
+servers_latencies_bucket{name="b",le="0.5"} 1
+servers_latencies_bucket{name="b",le="1"} 1
+servers_latencies_bucket{name="b",le="+Inf"} 1
+servers_latencies_sum{name="b"} 0.1
+servers_latencies_count{name="b"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+}
+
+func TestDoWalkJSONConflicts(t *testing.T) {
+	counter := []jsonwalk.MetricTypeRule{{Type: "counter"}}
+	counter[0].Path.Set("^a-b$")
+
+	testData := []struct {
+		name     string
+		json     string
+		opts     jsonwalk.Options
+		expected string
+		errors   float64
+	}{
+		{
+			name: "different label sets",
+			json: `{"a.b": [1], "a_b": {"array_0": 2}}`,
+			expected: `# HELP a_b::array_0 Retrieved value
+# TYPE a_b::array_0 gauge
+a_b::array_0{array_0_index="0"} 1
+`,
+			errors: 1,
+		},
+		{
+			name: "different types",
+			json: `{"a-b": 1, "a_b": 2}`,
+			opts: jsonwalk.Options{MetricTypes: counter},
+			expected: `# HELP a_b Retrieved value
+# TYPE a_b counter
+a_b 1
+`,
+			errors: 1,
+		},
+		{
+			name: "same labels",
+			json: `{"a-b": 1, "a_b": 2}`,
+			expected: `# HELP a_b Retrieved value
+# TYPE a_b gauge
+a_b 1
+`,
+			errors: 1,
+		},
+		{
+			name: "same counter labels",
+			json: `{"a-b": 1, "a_b": 2}`,
+			opts: jsonwalk.Options{MetricTypes: counter},
+			expected: `# HELP a_b Retrieved value
+# TYPE a_b counter
+a_b 1
+`,
+			errors: 1,
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var jsonData interface{}
+			if err := json.Unmarshal([]byte(tt.json), &jsonData); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+
+			errors := testutil.ToFloat64(walkErrorsTotal)
+			registry := prometheus.NewRegistry()
+			doWalkJSON("", jsonData, registry, tt.opts, log.NewNopLogger())
+			if err := testutil.GatherAndCompare(registry, strings.NewReader(tt.expected)); err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			if got := testutil.ToFloat64(walkErrorsTotal) - errors; got != tt.errors {
+				t.Errorf("Got errors: %v, expected: %v", got, tt.errors)
+			}
+		})
+	}
+}
+
+func TestDoWalkJSONScale(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"disk": {"used_bytes": 2500000, "ratio": 0.25}, "count": 3}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	var opts jsonwalk.Options
+	rules := []jsonwalk.ScaleRule{{Factor: 1e-6}, {Factor: 100}, {Factor: 2}}
+	rules[0].Path.Set("::used_bytes$")
+	rules[1].Path.Set("ratio")
+	rules[2].Path.Set("^disk::")
+	opts.Scale = rules
+
+	registry := prometheus.NewRegistry()
+	doWalkJSON("", jsonData, registry, opts, log.NewNopLogger())
+	families, err := registry.Gather()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	actual := map[string]float64{}
+	for _, family := range families {
+		actual[family.GetName()] = family.Metric[0].GetGauge().GetValue()
+	}
+	expected := map[string]float64{
+		"count":            3,
+		"disk::ratio":      25,
+		"disk::used_bytes": 2.5,
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got: %v, expected: %v", actual, expected)
+	}
+}
+
+func TestDoWalkJSONHelp(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"latency": {"p99": 0.2}, "memory": {"used_bytes": 10}, "count": 3}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	var opts jsonwalk.Options
+	rules := []jsonwalk.HelpRule{{Help: "Latency percentile {path}", Unit: "seconds"}, {Unit: "bytes"}}
+	rules[0].Path.Set("^latency::")
+	rules[1].Path.Set("^memory::")
+	opts.Help = rules
+
+	registry := prometheus.NewRegistry()
+	doWalkJSON("", jsonData, registry, opts, log.NewNopLogger())
+	families, err := registry.Gather()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	actual := map[string]string{}
+	for _, family := range families {
+		actual[family.GetName()] = family.GetHelp()
+	}
+	expected := map[string]string{
+		"count":                "Retrieved value",
+		"latency::p99_seconds": "Latency percentile latency::p99",
+		"memory::used_bytes":   "Retrieved value",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got: %v, expected: %v", actual, expected)
+	}
+}
+
+func TestWalkJSONValueTypes(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"a": 1, "b": 1.5, "c": true, "d": "ok", "e": null, "f": [1, {"g": 2}]}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	stats := doWalkJSON("", jsonData, prometheus.NewRegistry(), jsonwalk.Options{}, log.NewNopLogger())
+	expected := map[string]int{
+		"float":  1,
+		"int":    3,
+		"bool":   1,
+		"string": 1,
+		"null":   1,
+		"array":  1,
+		"object": 2,
+	}
+	if !reflect.DeepEqual(stats.ValueTypes, expected) {
+		t.Errorf("Got: %v, expected: %v", stats.ValueTypes, expected)
+	}
+}
+
+func TestDoProbeAuth(t *testing.T) {
+	testData := []struct {
+		name     string
+		opts     probeOptions
+		expected string
+	}{
+		{
+			name:     "no credentials",
+			opts:     probeOptions{},
+			expected: "",
+		},
+		{
+			name:     "basic auth",
+			opts:     probeOptions{Username: "user", Password: "pass"},
+			expected: "Basic dXNlcjpwYXNz",
+		},
+		{
+			name:     "bearer token",
+			opts:     probeOptions{BearerToken: "secret"},
+			expected: "Bearer secret",
+		},
+		{
+			name:     "passed through header",
+			opts:     probeOptions{Authorization: "Custom abc"},
+			expected: "Custom abc",
+		},
+		{
+			name:     "basic auth wins over passed through header",
+			opts:     probeOptions{Username: "user", Password: "pass", Authorization: "Custom abc"},
+			expected: "Basic dXNlcjpwYXNz",
+		},
+		{
+			name:     "header wins over passed through header",
+			opts:     probeOptions{Headers: map[string]headerValues{"Authorization": {"Custom module"}}, Authorization: "Custom abc"},
+			expected: "Custom module",
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var actual string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual = r.Header.Get("Authorization")
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			_, _, err := doProbe(context.Background(), server.Client(), server.URL, tt.opts)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			if actual != tt.expected {
+				t.Errorf("Got: %q, expected: %q", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerForwardAuthorization(t *testing.T) {
+	var actual string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	defer func(m Module) { defaultModule = m }(defaultModule)
+
+	testData := []struct {
+		name                 string
+		forwardAuthorization bool
+		expected             string
+	}{
+		{name: "not forwarded", forwardAuthorization: false, expected: ""},
+		{name: "forwarded", forwardAuthorization: true, expected: "Basic ZXhwb3J0ZXI6c2VjcmV0"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultModule.Probe.ForwardAuthorization = tt.forwardAuthorization
+			actual = "unset"
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL, nil)
+			req.SetBasicAuth("exporter", "secret")
+			probeHandler(httptest.NewRecorder(), req, log.NewNopLogger())
+			if actual != tt.expected {
+				t.Errorf("Got: %q, expected: %q", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDoProbeCredentialFiles(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	passwordFile := filepath.Join(dir, "password")
+	emptyFile := filepath.Join(dir, "empty")
+	for path, content := range map[string]string{tokenFile: "secret\n", passwordFile: "pass\n", emptyFile: " \n"} {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	testData := []struct {
+		name     string
+		opts     probeOptions
+		expected string
+		err      string
+	}{
+		{
+			name:     "token file",
+			opts:     probeOptions{BearerTokenFile: tokenFile},
+			expected: "Bearer secret",
+		},
+		{
+			name:     "password file",
+			opts:     probeOptions{Username: "user", PasswordFile: passwordFile},
+			expected: "Basic dXNlcjpwYXNz",
+		},
+		{
+			name:     "token wins over token file",
+			opts:     probeOptions{BearerToken: "other", BearerTokenFile: tokenFile},
+			expected: "Bearer other",
+		},
+		{
+			name: "missing token file",
+			opts: probeOptions{BearerTokenFile: filepath.Join(dir, "missing")},
+			err:  "reading bearer token file",
+		},
+		{
+			name: "empty password file",
+			opts: probeOptions{Username: "user", PasswordFile: emptyFile},
+			err:  "password file " + emptyFile + " is empty",
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, requested := "", false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual, requested = r.Header.Get("Authorization"), true
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			_, _, err := doProbe(context.Background(), server.Client(), server.URL, tt.opts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Got error: %v, expected: %s", err, tt.err)
+				}
+				if requested {
+					t.Errorf("Got a request, expected none")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			if actual != tt.expected {
+				t.Errorf("Got: %q, expected: %q", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerProbeSuccess(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	testData := []struct {
+		name     string
+		target   string
+		expected []string
+	}{
+		{
+			name:     "reachable target",
+			target:   server.URL,
+			expected: []string{"probe_success 1\n", "x 1\n"},
+		},
+		{
+			name:     "unreachable target",
+			target:   unreachable.URL,
+			expected: []string{"probe_success 0\n", "probe_duration_seconds "},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/probe?target="+tt.target, nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusOK)
+			}
+			body := rec.Body.String()
+			for _, expected := range tt.expected {
+				if !strings.Contains(body, expected) {
+					t.Errorf("Got: %s, expected to contain: %s", body, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeHandlerStopsAfterProbeError(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	req := httptest.NewRequest("GET", "/probe?target="+unreachable.URL, nil)
+	rec := httptest.NewRecorder()
+	probeHandler(rec, req, log.NewNopLogger())
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusOK)
+	}
+	body := rec.Body.String()
+	for _, unexpected := range []string{"connection refused", "probe_max_depth", "probe_value_types"} {
+		if strings.Contains(body, unexpected) {
+			t.Errorf("Got: %s, expected not to contain: %s", body, unexpected)
+		}
+	}
+}
+
+func TestProbeHandlerOpenMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	testData := []struct {
+		name        string
+		accept      string
+		contentType string
+		eof         bool
+	}{
+		{
+			name:        "text format",
+			accept:      "",
+			contentType: "text/plain; version=0.0.4",
+		},
+		{
+			name:        "OpenMetrics",
+			accept:      "application/openmetrics-text; version=1.0.0",
+			contentType: "application/openmetrics-text; version=1.0.0",
+			eof:         true,
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, tt.contentType) {
+				t.Errorf("Got: %v, expected: %v", contentType, tt.contentType)
+			}
+			body := rec.Body.String()
+			// OpenMetrics writes the value as 1.0.
+			if !strings.Contains(body, "\nx 1") {
+				t.Errorf("Got: %s, expected to contain: %s", body, "x 1")
+			}
+			if eof := strings.HasSuffix(body, "# EOF\n"); eof != tt.eof {
+				t.Errorf("Got: %s, expected # EOF: %v", body, tt.eof)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerParseSuccess(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/malformed" {
+			w.Write([]byte(`{"x": 1`))
+			return
+		}
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	testData := []struct {
+		name     string
+		target   string
+		expected []string
+	}{
+		{
+			name:     "valid",
+			target:   server.URL,
+			expected: []string{"json_parse_success 1\n", "probe_success 1\n"},
+		},
+		{
+			name:     "malformed",
+			target:   server.URL + "/malformed",
+			expected: []string{"json_parse_success 0\n", "probe_success 0\n"},
+		},
+		{
+			name:     "unreachable",
+			target:   unreachable.URL,
+			expected: []string{"json_parse_success 1\n", "probe_success 0\n"},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/probe?target="+tt.target, nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusOK)
+			}
+			for _, expected := range tt.expected {
+				if !strings.Contains(rec.Body.String(), expected) {
+					t.Errorf("Got: %s, expected to contain: %s", rec.Body.String(), expected)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectRoot(t *testing.T) {
+	jsonData := map[string]interface{}{
+		"data": map[string]interface{}{
+			"metrics": map[string]interface{}{"x": json.Number("1")},
+			"items":   []interface{}{json.Number("2")},
+		},
+	}
+
+	testData := []struct {
+		name     string
+		root     string
+		expected interface{}
+		err      string
+	}{
+		{
+			name:     "empty",
+			root:     "",
+			expected: jsonData,
+		},
+		{
+			name:     "dots",
+			root:     "data.metrics",
+			expected: map[string]interface{}{"x": json.Number("1")},
+		},
+		{
+			name:     "separator",
+			root:     "data::metrics",
+			expected: map[string]interface{}{"x": json.Number("1")},
+		},
+		{
+			name:     "array index",
+			root:     "data.items.0",
+			expected: json.Number("2"),
+		},
+		{
+			name: "missing key",
+			root: "data.other",
+			err:  `root "data.other" not found: no key "other"`,
+		},
+		{
+			name: "index out of range",
+			root: "data.items.1",
+			err:  `root "data.items.1" not found: no index "1"`,
+		},
+		{
+			name: "below a value",
+			root: "data.metrics.x.y",
+			err:  `root "data.metrics.x.y" not found: "y" is not in an object or array`,
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := selectRoot(jsonData, tt.root)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Got error: %v, expected: %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerRoot(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"metrics": {"x": 1}}, "y": 2}`))
+	}))
+	defer server.Close()
+
+	testData := []struct {
+		name       string
+		query      string
+		expected   []string
+		unexpected []string
+	}{
+		{
+			name:       "subtree",
+			query:      "&root=data.metrics&prefix=app",
+			expected:   []string{"app::x 1\n", "probe_success 1\n"},
+			unexpected: []string{"y 2"},
+		},
+		{
+			name:       "missing subtree",
+			query:      "&root=data.other",
+			expected:   []string{"probe_success 0\n"},
+			unexpected: []string{"x 1", "y 2"},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL+tt.query, nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			body := rec.Body.String()
+			for _, expected := range tt.expected {
+				if !strings.Contains(body, expected) {
+					t.Errorf("Got: %s, expected to contain: %s", body, expected)
+				}
+			}
+			for _, unexpected := range tt.unexpected {
+				if strings.Contains(body, unexpected) {
+					t.Errorf("Got: %s, expected not to contain: %s", body, unexpected)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeHandlerSelfMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	successes := testutil.ToFloat64(probesTotal.WithLabelValues("success"))
+	failures := testutil.ToFloat64(probesTotal.WithLabelValues("failure"))
+	httpErrors := testutil.ToFloat64(httpErrorsTotal)
+
+	for _, target := range []string{server.URL, server.URL, unreachable.URL} {
+		req := httptest.NewRequest("GET", "/probe?target="+target, nil)
+		probeHandler(httptest.NewRecorder(), req, log.NewNopLogger())
+	}
+
+	if got := testutil.ToFloat64(probesTotal.WithLabelValues("success")) - successes; got != 2 {
+		t.Errorf("Got: %v successes, expected: 2", got)
+	}
+	if got := testutil.ToFloat64(probesTotal.WithLabelValues("failure")) - failures; got != 1 {
+		t.Errorf("Got: %v failures, expected: 1", got)
+	}
+	if got := testutil.ToFloat64(httpErrorsTotal) - httpErrors; got != 1 {
+		t.Errorf("Got: %v HTTP errors, expected: 1", got)
+	}
+
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, expected := range []string{"json_exporter_probe_duration_seconds_count", "json_exporter_walk_errors_total", "json_exporter_build_info{"} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("Got: %s, expected to contain: %s", rec.Body.String(), expected)
+		}
+	}
+}
+
+func TestProbeHandlerMultipleTargets(t *testing.T) {
+	var servers []*httptest.Server
+	for _, body := range []string{`{"x": 1}`, `{"x": 2, "y": [3]}`} {
+		body := body
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}))
+		defer server.Close()
+		servers = append(servers, server)
+	}
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	query := url.Values{"target": {servers[0].URL, servers[1].URL, unreachable.URL}}
+	req := httptest.NewRequest("GET", "/probe?"+query.Encode(), nil)
+	rec := httptest.NewRecorder()
+	probeHandler(rec, req, log.NewNopLogger())
+
+	body := rec.Body.String()
+	for _, expected := range []string{
+		`x{target="` + servers[0].URL + `"} 1`,
+		`x{target="` + servers[1].URL + `"} 2`,
+		`y::array_0{array_0_index="0",target="` + servers[1].URL + `"} 3`,
+		`probe_success{target="` + servers[0].URL + `"} 1`,
+		`probe_success{target="` + servers[1].URL + `"} 1`,
+		`probe_success{target="` + unreachable.URL + `"} 0`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Got: %s, expected to contain: %s", body, expected)
+		}
+	}
+}
+
+func TestProbeHandlerDuplicateTargets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	query := url.Values{"target": {server.URL, server.URL, server.URL + "/other"}}
+	req := httptest.NewRequest("GET", "/probe?"+query.Encode(), nil)
+	rec := httptest.NewRecorder()
+	probeHandler(rec, req, log.NewNopLogger())
+
+	body := rec.Body.String()
+	for _, expected := range []string{
+		`probe_success{target="` + server.URL + `"} 1`,
+		`probe_success{target="` + server.URL + `/other"} 1`,
+	} {
+		if strings.Count(body, expected) != 1 {
+			t.Errorf("Got: %s, expected to contain once: %s", body, expected)
+		}
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	testData := []struct {
+		input    string
+		expected time.Duration
+		err      bool
+	}{
+		{input: "5s", expected: 5 * time.Second},
+		{input: "250ms", expected: 250 * time.Millisecond},
+		{input: "4.5", expected: 4500 * time.Millisecond},
+		{input: "10", expected: 10 * time.Second},
+		{input: "0", err: true},
+		{input: "-1s", err: true},
+		{input: "soon", err: true},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.input, func(t *testing.T) {
+			actual, err := parseTimeout(tt.input)
+			if tt.err {
+				if err == nil {
+					t.Errorf("Expected an error, got: %v", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			if actual != tt.expected {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDoProbeTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": `))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	_, _, err := doProbe(context.Background(), server.Client(), server.URL, probeOptions{Timeout: 100 * time.Millisecond})
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Timeout not honored while reading the body, took %v", elapsed)
+	}
+}
+
+func TestProbeHandlerScrapeTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	defer func(offset time.Duration) { scrapeTimeoutOffset = offset }(scrapeTimeoutOffset)
+
+	testData := []struct {
+		name    string
+		query   string
+		header  string
+		offset  time.Duration
+		status  int
+		success bool
+	}{
+		{name: "header shorter than the probe", header: "0.6", offset: 500 * time.Millisecond, status: http.StatusOK, success: false},
+		{name: "header shorter than the probe with the offset", header: "1.2", offset: 500 * time.Millisecond, status: http.StatusOK, success: false},
+		{name: "header longer than the probe with a smaller offset", header: "1.2", offset: 100 * time.Millisecond, status: http.StatusOK, success: true},
+		{name: "timeout parameter shorter than header", query: "&timeout=0.1", header: "10", status: http.StatusOK, success: false},
+		{name: "header longer than the probe", header: "5", status: http.StatusOK, success: true},
+		{name: "invalid header", header: "soon", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			scrapeTimeoutOffset = tt.offset
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL+tt.query, nil)
+			req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tt.header)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			if rec.Code != tt.status {
+				t.Errorf("Got status: %d, expected: %d", rec.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			expected := "probe_success 0"
+			if tt.success {
+				expected = "probe_success 1"
+			}
+			if !strings.Contains(rec.Body.String(), expected) {
+				t.Errorf("Got: %s, expected to contain: %s", rec.Body.String(), expected)
+			}
+		})
+	}
+}
+
+func TestDoProbeRetries(t *testing.T) {
+	testData := []struct {
+		name     string
+		failures int
+		status   int
+		opts     probeOptions
+		attempts int
+		err      bool
+	}{
+		{
+			name:     "no retries",
+			failures: 1,
+			status:   http.StatusServiceUnavailable,
+			opts:     probeOptions{ValidStatusCodes: []int{200}},
+			attempts: 1,
+			err:      true,
+		},
+		{
+			name:     "retried until success",
+			failures: 2,
+			status:   http.StatusBadGateway,
+			opts:     probeOptions{MaxRetries: 3, RetryBaseDelay: time.Millisecond},
+			attempts: 3,
+		},
+		{
+			name:     "retries exhausted",
+			failures: 5,
+			status:   http.StatusGatewayTimeout,
+			opts:     probeOptions{MaxRetries: 2, RetryBaseDelay: time.Millisecond, ValidStatusCodes: []int{200}},
+			attempts: 3,
+			err:      true,
+		},
+		{
+			name:     "client error not retried",
+			failures: 1,
+			status:   http.StatusNotFound,
+			opts:     probeOptions{MaxRetries: 3, RetryBaseDelay: time.Millisecond, ValidStatusCodes: []int{200}},
+			attempts: 1,
+			err:      true,
+		},
+		{
+			name:     "custom retry status codes",
+			failures: 1,
+			status:   http.StatusTooManyRequests,
+			opts:     probeOptions{MaxRetries: 1, RetryBaseDelay: time.Millisecond, RetryStatusCodes: []int{429}},
+			attempts: 2,
+		},
+		{
+			name:     "retries bounded by timeout",
+			failures: 5,
+			status:   http.StatusServiceUnavailable,
+			opts:     probeOptions{MaxRetries: 5, RetryBaseDelay: time.Second, Timeout: 100 * time.Millisecond},
+			attempts: 1,
+			err:      true,
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if attempts <= tt.failures {
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"x": 1}`))
+			}))
+			defer server.Close()
+
+			start := time.Now()
+			trace := &probeTrace{}
+			_, _, err := doProbe(withProbeTrace(context.Background(), trace), server.Client(), server.URL, tt.opts)
+			if (err != nil) != tt.err {
+				t.Errorf("Got error: %v, expected error: %v", err, tt.err)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("Got: %d attempts, expected: %d", attempts, tt.attempts)
+			}
+			if retries := trace.retryCount(); retries != tt.attempts-1 {
+				t.Errorf("Got: %d retries, expected: %d", retries, tt.attempts-1)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("Retries outlived the timeout, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		case "/older":
+			http.Redirect(w, r, "/old", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	defer func(m Module) { defaultModule = m }(defaultModule)
+
+	testData := []struct {
+		name            string
+		path            string
+		followRedirects bool
+		maxRedirects    int
+		expected        []string
+	}{
+		{
+			name:            "followed",
+			path:            "/old",
+			followRedirects: true,
+			expected: []string{
+				"probe_success 1",
+				"probe_http_status_code 200",
+				"probe_http_redirects 1",
+				`probe_http_final_url_info{url="` + server.URL + `/new"} 1`,
+			},
+		},
+		{
+			name:            "followed twice",
+			path:            "/older",
+			followRedirects: true,
+			maxRedirects:    2,
+			expected: []string{
+				"probe_success 1",
+				"probe_http_redirects 2",
+				`probe_http_final_url_info{url="` + server.URL + `/new"} 1`,
+			},
+		},
+		{
+			name:            "too many redirects",
+			path:            "/older",
+			followRedirects: true,
+			maxRedirects:    1,
+			expected: []string{
+				"probe_success 0",
+				"probe_http_redirects 1",
+			},
+		},
+		{
+			name:            "not followed",
+			path:            "/old",
+			followRedirects: false,
+			expected: []string{
+				"probe_success 0",
+				"probe_http_status_code 302",
+				"probe_http_redirects 0",
+				`probe_http_final_url_info{url="` + server.URL + `/old"} 1`,
+			},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultModule.Probe.FollowRedirects = tt.followRedirects
+			defaultModule.Probe.MaxRedirects = tt.maxRedirects
+
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL+tt.path, nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			body := rec.Body.String()
+			for _, expected := range tt.expected {
+				if !strings.Contains(body, expected) {
+					t.Errorf("Got: %s, expected to contain: %s", body, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeHandlerFinalURLRedacted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	target := strings.Replace(server.URL, "http://", "http://user:s3cret@", 1)
+	req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(target), nil)
+	rec := httptest.NewRecorder()
+	probeHandler(rec, req, log.NewNopLogger())
+
+	body := rec.Body.String()
+	if strings.Contains(body, "s3cret") {
+		t.Errorf("Got: %s, expected the password to be redacted", body)
+	}
+	expected := `probe_http_final_url_info{url="` + strings.Replace(server.URL, "http://", "http://user:xxxxx@", 1) + `"} 1`
+	if !strings.Contains(body, expected) {
+		t.Errorf("Got: %s, expected to contain: %s", body, expected)
+	}
+}
+
+func TestProbeHandlerRedirectForwardAuth(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer other.Close()
+	// Redirect to the other server by another name, so that it is another
+	// host to the client.
+	otherURL := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, otherURL, http.StatusFound)
+	}))
+	defer server.Close()
+
+	defer func(m Module) { defaultModule = m }(defaultModule)
+	defaultModule.Probe.FollowRedirects = true
+	defaultModule.Probe.Headers = map[string]headerValues{"Authorization": {"Bearer secret"}}
+
+	testData := []struct {
+		name        string
+		forwardAuth bool
+		expected    string
+	}{
+		{name: "not forwarded", forwardAuth: false, expected: "probe_success 0"},
+		{name: "forwarded", forwardAuth: true, expected: "probe_success 1"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultModule.Probe.RedirectForwardAuth = tt.forwardAuth
+
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL, nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			if body := rec.Body.String(); !strings.Contains(body, tt.expected) {
+				t.Errorf("Got: %s, expected to contain: %s", body, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDoProbeContentType(t *testing.T) {
+	testData := []struct {
+		name        string
+		contentType string
+		opts        probeOptions
+		err         string
+	}{
+		{name: "json", contentType: "application/json"},
+		{name: "json with charset", contentType: "application/json; charset=utf-8"},
+		{name: "json suffix", contentType: "application/problem+json"},
+		{name: "html", contentType: "text/html; charset=utf-8", err: `unexpected Content-Type "text/html; charset=utf-8", expected JSON`},
+		{name: "missing", contentType: "", err: `unexpected Content-Type "", expected JSON`},
+		{name: "ignored", contentType: "text/plain", opts: probeOptions{IgnoreContentType: true}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header()["Content-Type"] = []string{tt.contentType}
+				w.Write([]byte(`{"x": 1}`))
+			}))
+			defer server.Close()
+
+			_, _, err := doProbe(context.Background(), server.Client(), server.URL, tt.opts)
+			if tt.err == "" && err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Errorf("Got: %v, expected error: %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer func(m Module) { defaultModule = m }(defaultModule)
+
+	testData := []struct {
+		name       string
+		caFile     string
+		serverName string
+		overrides  bool
+		query      string
+		expected   string
+	}{
+		{
+			name:     "untrusted certificate",
+			expected: "probe_success 0\n",
+		},
+		{
+			name:     "insecure parameter refused",
+			query:    "&insecure=true",
+			expected: `parameter "insecure" is not allowed by the module`,
+		},
+		{
+			name:      "insecure parameter",
+			overrides: true,
+			query:     "&insecure=true",
+			expected:  "probe_success 1\n",
+		},
+		{
+			name:     "trusted CA file",
+			caFile:   caFile,
+			expected: "probe_success 1\n",
+		},
+		{
+			name:       "server name of the certificate",
+			caFile:     caFile,
+			serverName: "example.com",
+			expected:   "probe_success 1\n",
+		},
+		{
+			name:       "server name not in the certificate",
+			caFile:     caFile,
+			serverName: "other.invalid",
+			expected:   "probe_success 0\n",
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultModule.Probe.TLS.CAFile = tt.caFile
+			defaultModule.Probe.TLS.ServerName = tt.serverName
+			defaultModule.AllowParamOverrides = tt.overrides
+
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL+tt.query, nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			if body := rec.Body.String(); !strings.Contains(body, tt.expected) {
+				t.Errorf("Got: %s, expected to contain: %s", body, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerClientCertificate(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "json-exporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	certFile := filepath.Join(t.TempDir(), "client.pem")
+	keyFile := filepath.Join(t.TempDir(), "client-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer func(tls TLSConfig) { defaultModule.Probe.TLS = tls }(defaultModule.Probe.TLS)
+
+	testData := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		expected string
+	}{
+		{
+			name:     "without certificate",
+			expected: "probe_success 0\n",
+		},
+		{
+			name:     "with certificate",
+			certFile: certFile,
+			keyFile:  keyFile,
+			expected: "probe_success 1\n",
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultModule.Probe.TLS = TLSConfig{InsecureSkipVerify: true, CertFile: tt.certFile, KeyFile: tt.keyFile}
+
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL, nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			if body := rec.Body.String(); !strings.Contains(body, tt.expected) {
+				t.Errorf("Got: %s, expected to contain: %s", body, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDoProbeMethodAndBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			http.Error(w, "unexpected content type "+ct, http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	query := "/probe?target=" + server.URL + "&method=post&content_type=application/json&body=" + url.QueryEscape(`{"x":{"y":3}}`)
+	rec := httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", query, nil), log.NewNopLogger())
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusBadRequest)
+	}
+
+	defer func(m Module) { defaultModule = m }(defaultModule)
+	defaultModule.AllowParamOverrides = true
+	rec = httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", query, nil), log.NewNopLogger())
+
+	body := rec.Body.String()
+	for _, expected := range []string{"probe_success 1\n", "x::y 3\n"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Got: %s, expected to contain: %s", body, expected)
+		}
+	}
+}
+
+func TestExpandBody(t *testing.T) {
+	testData := []struct {
+		name     string
+		body     string
+		query    string
+		expected string
+		err      string
+	}{
+		{name: "verbatim", body: `{"query": "{ stats { count } }"}`, query: "index=logs", expected: `{"query": "{ stats { count } }"}`},
+		{name: "parameter", body: `{"index": "{{ .index }}"}`, query: "index=logs&index=other", expected: `{"index": "logs"}`},
+		{name: "json", body: `{"q": {{ json .q }}}`, query: "q=" + url.QueryEscape(`a "b"`), expected: `{"q": "a \"b\""}`},
+		{name: "missing parameter", body: `{"index": "{{ .index }}"}`, err: `invalid body template: template: body:1:14: executing "body" at <.index>: map has no entry for key "index"`},
+		{name: "invalid", body: `{{ .index`, err: `invalid body template: template: body:1: unclosed action`},
+	}
+	for _, data := range testData {
+		t.Run(data.name, func(t *testing.T) {
+			params, _ := url.ParseQuery(data.query)
+			actual, err := expandBody(data.body, params)
+			if data.err != "" {
+				if err == nil || err.Error() != data.err {
+					t.Errorf("Got: %v, expected: %v", err, data.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if actual != data.expected {
+				t.Errorf("Got: %v, expected: %v", actual, data.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerBodyTemplate(t *testing.T) {
+	var actual string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		actual = string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"hits": 3}`))
+	}))
+	defer server.Close()
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{Modules: map[string]Module{
+		"search": {Probe: probeOptions{Method: "POST", Body: `{"index": "{{ .index }}"}`, ContentType: "application/json"}},
+	}}
+
+	req := httptest.NewRequest("GET", "/probe?module=search&index=logs&target="+server.URL, nil)
+	rec := httptest.NewRecorder()
+	probeHandler(rec, req, log.NewNopLogger())
+	if expected := `{"index": "logs"}`; actual != expected {
+		t.Errorf("Got: %v, expected: %v", actual, expected)
+	}
+
+	req = httptest.NewRequest("GET", "/probe?module=search&target="+server.URL, nil)
+	rec = httptest.NewRecorder()
+	probeHandler(rec, req, log.NewNopLogger())
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Got: %v, expected: %v", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDoProbeHeaders(t *testing.T) {
+	var actual http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual = r.Header
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	opts := probeOptions{
+		Headers: map[string]headerValues{
+			"Accept":    {"application/json"},
+			"X-Api-Key": {"secret"},
+			"X-Tenant":  {"a", "b"},
+		},
+	}
+	if _, _, err := doProbe(context.Background(), server.Client(), server.URL, opts); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for name, expected := range opts.Headers {
+		if values := actual.Values(name); !reflect.DeepEqual(values, []string(expected)) {
+			t.Errorf("Got %s: %v, expected: %v", name, values, expected)
+		}
+	}
+}
+
+func TestDoProbeCompression(t *testing.T) {
+	document := []byte(`{"x": 1}`)
+	var gzipped, zlibbed, deflated bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(document)
+	gz.Close()
+	zw := zlib.NewWriter(&zlibbed)
+	zw.Write(document)
+	zw.Close()
+	fw, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	fw.Write(document)
+	fw.Close()
+	encoder, _ := zstd.NewWriter(nil)
+	zstded := encoder.EncodeAll(document, nil)
+
+	testData := []struct {
+		name           string
+		encoding       string
+		acceptEncoding string
+		body           []byte
+		expected       interface{}
+		err            string
+	}{
+		{
+			name:     "gzipped JSON",
+			encoding: "gzip",
+			body:     gzipped.Bytes(),
+			expected: map[string]interface{}{"x": json.Number("1")},
+		},
+		{
+			// Asking for gzip explicitly stops the transport from
+			// decompressing the response itself.
+			name:           "gzip asked for",
+			encoding:       "gzip",
+			acceptEncoding: "gzip",
+			body:           gzipped.Bytes(),
+			expected:       map[string]interface{}{"x": json.Number("1")},
+		},
+		{
+			name:     "invalid gzip",
+			encoding: "gzip",
+			body:     document,
+			err:      "decompressing gzip response",
+		},
+		{
+			name:     "zlib deflate",
+			encoding: "deflate",
+			body:     zlibbed.Bytes(),
+			expected: map[string]interface{}{"x": json.Number("1")},
+		},
+		{
+			name:     "raw deflate",
+			encoding: "deflate",
+			body:     deflated.Bytes(),
+			expected: map[string]interface{}{"x": json.Number("1")},
+		},
+		{
+			name:     "zstd",
+			encoding: "zstd",
+			body:     zstded,
+			expected: map[string]interface{}{"x": json.Number("1")},
+		},
+		{
+			name:     "invalid zstd",
+			encoding: "zstd",
+			body:     document,
+			err:      "decompressing zstd response",
+		},
+		{
+			name:     "unsupported encoding",
+			encoding: "br",
+			body:     document,
+			err:      `unsupported Content-Encoding "br"`,
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var accepted string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				accepted = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Encoding", tt.encoding)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(tt.body)
+			}))
+			defer server.Close()
+
+			opts := probeOptions{}
+			expectedAccept := acceptEncoding
+			if tt.acceptEncoding != "" {
+				opts.Headers = map[string]headerValues{"Accept-Encoding": {tt.acceptEncoding}}
+				expectedAccept = tt.acceptEncoding
+			}
+			actual, _, err := doProbe(context.Background(), server.Client(), server.URL, opts)
+			if accepted != expectedAccept {
+				t.Errorf("Got Accept-Encoding: %s, expected: %s", accepted, expectedAccept)
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Got: %v, expected error containing: %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDoProbeMaxBodyBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 12345}`))
+	}))
+	defer server.Close()
+
+	testData := []struct {
+		name         string
+		maxBodyBytes int64
+		err          string
+	}{
+		{name: "within limit", maxBodyBytes: 12},
+		{name: "over limit", maxBodyBytes: 11, err: "response too large"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := doProbe(context.Background(), server.Client(), server.URL, probeOptions{MaxBodyBytes: tt.maxBodyBytes})
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("Error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Got: %v, expected error containing: %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerStatusCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{Modules: map[string]Module{
+		"strict":      {Probe: probeOptions{ValidStatusCodes: []int{200}}},
+		"unavailable": {Probe: probeOptions{ValidStatusCodes: []int{200, 503}}},
+	}}
+
+	testData := []struct {
+		name       string
+		query      string
+		expected   []string
+		unexpected []string
+	}{
+		{
+			name:       "not 2xx",
+			expected:   []string{"probe_http_status_code 503\n", "probe_http_content_length 8\n", "probe_success 0\n"},
+			unexpected: []string{"x 1\n"},
+		},
+		{
+			name:       "invalid status code",
+			query:      "&module=strict",
+			expected:   []string{"probe_http_status_code 503\n", "probe_success 0\n"},
+			unexpected: []string{"x 1\n"},
+		},
+		{
+			name:     "valid status code",
+			query:    "&module=unavailable",
+			expected: []string{"probe_http_status_code 503\n", "probe_success 1\n", "x 1\n"},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/probe?target="+server.URL+tt.query, nil)
+			rec := httptest.NewRecorder()
+			probeHandler(rec, req, log.NewNopLogger())
+
+			body := rec.Body.String()
+			for _, expected := range tt.expected {
+				if !strings.Contains(body, expected) {
+					t.Errorf("Got: %s, expected to contain: %s", body, expected)
+				}
+			}
+			for _, unexpected := range tt.unexpected {
+				if strings.Contains(body, unexpected) {
+					t.Errorf("Got: %s, expected not to contain: %s", body, unexpected)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeTargetFile(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	if err := ioutil.WriteFile(valid, []byte(`{"x": 1}`), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalid, []byte(`not json`), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	testData := []struct {
+		name     string
+		target   string
+		expected interface{}
+		err      string
+	}{
+		{
+			name:     "valid file",
+			target:   "file://" + valid,
+			expected: map[string]interface{}{"x": json.Number("1")},
+		},
+		{
+			name:   "missing file",
+			target: "file://" + filepath.Join(dir, "missing.json"),
+			err:    "no such file or directory",
+		},
+		{
+			name:   "invalid JSON",
+			target: "file://" + invalid,
+			err:    "reading " + invalid,
+		},
+		{
+			name:   "relative path",
+			target: "file://valid.json",
+			err:    "expected file:///absolute/path",
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, resp, err := probeTarget(context.Background(), tt.target, probeOptions{})
+			if resp != nil {
+				t.Errorf("Got response: %v, expected none", resp)
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Got: %v, expected error containing: %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerFileParseSuccess(t *testing.T) {
+	dir := t.TempDir()
+	defer func(dirs []string) { allowedFileDirs = dirs }(allowedFileDirs)
+	allowedFileDirs = []string{dir}
+	path := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(path, []byte(`{"x": `), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", "/probe?target=file://"+path, nil), log.NewNopLogger())
+	body := rec.Body.String()
+	for _, expected := range []string{"probe_success 0\n", "json_parse_success 0\n"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Got: %s, expected to contain: %s", body, expected)
+		}
+	}
+}
+
+func TestProbeHandlerFileExportStrings(t *testing.T) {
+	dir := t.TempDir()
+	defer func(dirs []string) { allowedFileDirs = dirs }(allowedFileDirs)
+	allowedFileDirs = []string{dir}
+	path := filepath.Join(dir, "secret.json")
+	if err := ioutil.WriteFile(path, []byte(`{"password": "s3cret"}`), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	query := "/probe?target=file://" + path + "&export_strings=true"
+
+	rec := httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", query, nil), log.NewNopLogger())
+	if rec.Code != http.StatusBadRequest || strings.Contains(rec.Body.String(), "s3cret") {
+		t.Errorf("Got status: %d, body: %s, expected: %d", rec.Code, rec.Body.String(), http.StatusBadRequest)
+	}
+
+	defer func(m Module) { defaultModule = m }(defaultModule)
+	defaultModule.AllowParamOverrides = true
+	rec = httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", query, nil), log.NewNopLogger())
+	if expected := `password{password="s3cret"} 1`; !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("Got: %s, expected to contain: %s", rec.Body.String(), expected)
+	}
+}
+
+func TestProbeTargetUnix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "json.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stats" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	actual, _, err := probeTarget(context.Background(), "unix://"+socket+":/stats", probeOptions{})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := map[string]interface{}{"x": json.Number("1")}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got: %v, expected: %v", actual, expected)
+	}
+}
+
+func TestProbeTargetProxy(t *testing.T) {
+	var requested string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer proxy.Close()
+
+	actual, _, err := probeTarget(context.Background(), "http://example.invalid/stats", probeOptions{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if requested != "http://example.invalid/stats" {
+		t.Errorf("Got: %v, expected: %v", requested, "http://example.invalid/stats")
+	}
+	expected := map[string]interface{}{"x": json.Number("1")}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got: %v, expected: %v", actual, expected)
+	}
+}
+
+func TestSplitUnixTarget(t *testing.T) {
+	testData := []struct {
+		target string
+		socket string
+		path   string
+	}{
+		{target: "unix:///run/app.sock", socket: "/run/app.sock", path: "/"},
+		{target: "unix:///run/app.sock:/v1/stats", socket: "/run/app.sock", path: "/v1/stats"},
+		{target: "unix:///run/app.sock:stats?x=1", socket: "/run/app.sock", path: "/stats?x=1"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.target, func(t *testing.T) {
+			socket, path := splitUnixTarget(tt.target)
+			if socket != tt.socket || path != tt.path {
+				t.Errorf("Got: %s %s, expected: %s %s", socket, path, tt.socket, tt.path)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+)
+
+// isNDJSONContentType reports whether contentType is one of the media types
+// used for newline delimited JSON, like application/x-ndjson.
+func isNDJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines", "application/json-seq":
+		return true
+	}
+	return false
+}
+
+// parseNDJSON parses newline delimited JSON, a JSON document on each line,
+// into an array holding a document per line, so that the lines are walked
+// as elements labeled with their index or their label_keys. Blank lines are
+// skipped and not counted.
+func parseNDJSON(data []byte) (interface{}, error) {
+	lines := []interface{}{}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		// Also accept JSON text sequences, whose records start with RS.
+		line = bytes.TrimSpace(bytes.TrimPrefix(bytes.TrimSpace(line), []byte("\x1e")))
+		if len(line) == 0 {
+			continue
+		}
+		jsonData, err := parseJSON(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		lines = append(lines, jsonData)
+	}
+	return lines, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestParseNDJSON(t *testing.T) {
+	testData := []struct {
+		name     string
+		ndjson   string
+		expected interface{}
+		err      string
+	}{
+		{
+			name:   "lines",
+			ndjson: "{\"id\": \"a\", \"count\": 1}\r\n\n{\"id\": \"b\", \"count\": 2}\n",
+			expected: []interface{}{
+				map[string]interface{}{"id": "a", "count": json.Number("1")},
+				map[string]interface{}{"id": "b", "count": json.Number("2")},
+			},
+		},
+		{
+			name:     "JSON text sequence",
+			ndjson:   "\x1e{\"count\": 1}\n\x1e3\n",
+			expected: []interface{}{map[string]interface{}{"count": json.Number("1")}, json.Number("3")},
+		},
+		{
+			name:     "empty",
+			ndjson:   "\n",
+			expected: []interface{}{},
+		},
+		{
+			name:   "invalid line",
+			ndjson: "{\"count\": 1}\n{\"count\": \n",
+			err:    "line 2: unexpected EOF",
+		},
+		{
+			name:   "several documents on a line",
+			ndjson: "{\"count\": 1} {\"count\": 2}\n",
+			err:    "line 1: invalid data after top-level value",
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := parseNDJSON([]byte(tt.ndjson))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Got error: %v, expected: %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerNDJSON(t *testing.T) {
+	testData := []struct {
+		name        string
+		contentType string
+		query       string
+		expected    []string
+	}{
+		{
+			name:        "NDJSON Content-Type",
+			contentType: "application/x-ndjson",
+			expected:    []string{`array_0::count{array_0_index="0"} 1`, `array_0::count{array_0_index="1"} 2`},
+		},
+		{
+			name:        "format parameter",
+			contentType: "text/plain",
+			query:       "&format=ndjson",
+			expected:    []string{`array_0::count{array_0_index="1"} 2`},
+		},
+		{
+			name:        "label keys",
+			contentType: "application/jsonl",
+			query:       "&label_keys=id",
+			expected:    []string{`count{id="a"} 1`, `count{id="b"} 2`},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte("{\"id\": \"a\", \"count\": 1}\n{\"id\": \"b\", \"count\": 2}\n"))
+			}))
+			defer server.Close()
+
+			rec := httptest.NewRecorder()
+			probeHandler(rec, httptest.NewRequest("GET", "/probe?target="+server.URL+tt.query, nil), log.NewNopLogger())
+			body := rec.Body.String()
+			for _, expected := range append(tt.expected, "probe_success 1") {
+				if !strings.Contains(body, expected) {
+					t.Errorf("Got: %s, expected to contain: %s", body, expected)
+				}
+			}
+		})
+	}
+}
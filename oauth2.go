@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// OAuth2Config gets the bearer token sent to targets from an OAuth2 token
+// endpoint with the client credentials flow.
+type OAuth2Config struct {
+	ClientID string `yaml:"client_id"`
+	// ClientSecret authenticates the client. ClientSecretFile holds it
+	// instead, re-read whenever a token is fetched.
+	ClientSecret     string   `yaml:"client_secret"`
+	ClientSecretFile string   `yaml:"client_secret_file"`
+	TokenURL         string   `yaml:"token_url"`
+	Scopes           []string `yaml:"scopes"`
+	// EndpointParams are added to the token requests, e.g. an audience.
+	EndpointParams map[string]string `yaml:"endpoint_params"`
+}
+
+func (c OAuth2Config) validate() error {
+	if c.ClientID == "" {
+		return fmt.Errorf("missing client_id")
+	}
+	if c.ClientSecret != "" && c.ClientSecretFile != "" {
+		return fmt.Errorf("at most one of client_secret and client_secret_file must be set")
+	}
+	u, err := url.Parse(c.TokenURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid token_url %q", c.TokenURL)
+	}
+	return nil
+}
+
+// key identifies the tokens fetched with c in oauth2Tokens.
+func (c OAuth2Config) key() string {
+	params := make([]string, 0, len(c.EndpointParams))
+	for name, value := range c.EndpointParams {
+		params = append(params, name+"="+value)
+	}
+	sort.Strings(params)
+	return strings.Join([]string{c.ClientID, c.ClientSecret, c.ClientSecretFile, c.TokenURL, strings.Join(c.Scopes, " "), strings.Join(params, "&")}, "\xff")
+}
+
+var (
+	// oauth2Tokens caches the tokens fetched by oauth2Token, by the key of
+	// their OAuth2Config, until they expire.
+	oauth2TokensMu sync.Mutex
+	oauth2Tokens   = map[string]*oauth2.Token{}
+)
+
+// oauth2Token returns a valid access token for c, fetching a new one with
+// client, whose transport is that of the probe, once the cached one is
+// about to expire.
+func oauth2Token(ctx context.Context, client *http.Client, c OAuth2Config) (string, error) {
+	key := c.key()
+	oauth2TokensMu.Lock()
+	token, ok := oauth2Tokens[key]
+	oauth2TokensMu.Unlock()
+	if ok && token.Valid() {
+		return token.AccessToken, nil
+	}
+
+	secret := c.ClientSecret
+	if c.ClientSecretFile != "" {
+		var err error
+		if secret, err = readCredentialFile("client secret", c.ClientSecretFile); err != nil {
+			return "", err
+		}
+	}
+	params := url.Values{}
+	for name, value := range c.EndpointParams {
+		params.Set(name, value)
+	}
+	config := clientcredentials.Config{
+		ClientID:       c.ClientID,
+		ClientSecret:   secret,
+		TokenURL:       c.TokenURL,
+		Scopes:         c.Scopes,
+		EndpointParams: params,
+	}
+	// Leave the probe's trace out of the token request, keeping its
+	// deadline.
+	tokenCtx := context.Background()
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		tokenCtx, cancel = context.WithDeadline(tokenCtx, deadline)
+		defer cancel()
+	}
+	tokenCtx = context.WithValue(tokenCtx, oauth2.HTTPClient, &http.Client{Transport: client.Transport})
+	token, err := config.Token(tokenCtx)
+	if err != nil {
+		return "", err
+	}
+
+	oauth2TokensMu.Lock()
+	oauth2Tokens[key] = token
+	oauth2TokensMu.Unlock()
+	return token.AccessToken, nil
+}
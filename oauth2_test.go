@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestDoProbeOAuth2(t *testing.T) {
+	defer func() { oauth2Tokens = map[string]*oauth2.Token{} }()
+
+	tokenRequests := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		id, secret, _ := r.BasicAuth()
+		if id != "exporter" || secret != "s3cret" || r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "read" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "token", "token_type": "bearer", "expires_in": 3600}`))
+	}))
+	defer tokenServer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	opts := probeOptions{OAuth2: &OAuth2Config{ClientID: "exporter", ClientSecret: "s3cret", TokenURL: tokenServer.URL, Scopes: []string{"read"}}}
+	for i := 0; i < 2; i++ {
+		if _, _, err := doProbe(context.Background(), server.Client(), server.URL, opts); err != nil {
+			t.Errorf("Error: %v", err)
+		}
+	}
+	if tokenRequests != 1 {
+		t.Errorf("Got: %d token requests, expected: 1", tokenRequests)
+	}
+
+	opts.OAuth2.ClientSecret = "wrong"
+	_, _, err := doProbe(context.Background(), server.Client(), server.URL, opts)
+	if err == nil || !strings.Contains(err.Error(), "fetching OAuth2 token") {
+		t.Errorf("Got: %v, expected error containing: fetching OAuth2 token", err)
+	}
+}
@@ -0,0 +1,164 @@
+package jsonwalk
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector exporting the samples of the document
+// returned by its fetch function, which is called on every collection. It
+// is unchecked, as the metrics depend on the document.
+type Collector struct {
+	prefix string
+	fetch  func() (interface{}, error)
+	opts   Options
+	logger log.Logger
+}
+
+// NewCollector returns a Collector naming the metrics of the documents
+// fetch returns after their path below prefix. When fetch fails, the
+// collection fails with its error.
+func NewCollector(prefix string, fetch func() (interface{}, error), opts Options, logger log.Logger) *Collector {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &Collector{prefix: prefix, fetch: fetch, opts: opts, logger: logger}
+}
+
+// Describe sends nothing, making the collector unchecked.
+func (c *Collector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect fetches the document and sends its samples. Samples whose series
+// was already sent, or whose name was sent with another type, help or label
+// names, are logged and skipped.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	jsonData, err := c.fetch()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("jsonwalk_fetch_error", "Error fetching the document", nil, nil), err)
+		return
+	}
+
+	samples, _ := Collect(c.prefix, jsonData, c.opts, c.logger)
+	descs := map[string]*prometheus.Desc{}
+	descKeys := map[string]string{}
+	series := map[string]bool{}
+	histograms := map[string]*constHistogram{}
+	var histogramIDs []string
+	for _, sample := range samples {
+		labelNames := make([]string, len(sample.Labels))
+		labelValues := make([]string, len(sample.Labels))
+		for i, label := range sample.Labels {
+			labelNames[i] = label.Name
+			labelValues[i] = label.Value
+		}
+
+		descKey := sample.Type + "\xff" + sample.Help + "\xff" + strings.Join(labelNames, "\xff")
+		desc, ok := descs[sample.Name]
+		if !ok {
+			desc = prometheus.NewDesc(sample.Name, sample.Help, labelNames, nil)
+			descs[sample.Name] = desc
+			descKeys[sample.Name] = descKey
+		} else if descKeys[sample.Name] != descKey {
+			level.Warn(c.logger).Log("msg", "Skipping value", "metric", sample.Name, "path", sample.Path, "err", "type, help or label names differ from an earlier value")
+			continue
+		}
+		id := sample.Name + "\xff" + strings.Join(labelValues, "\xff")
+		if h, ok := histograms[id]; ok && h.path == sample.Path {
+			h.observe(sample.Value)
+			continue
+		}
+		if series[id] {
+			level.Warn(c.logger).Log("msg", "Skipping value", "metric", sample.Name, "path", sample.Path, "err", "duplicate of an earlier series")
+			continue
+		}
+		series[id] = true
+		if sample.Type == "histogram" {
+			h := newConstHistogram(desc, sample, labelValues)
+			h.observe(sample.Value)
+			histograms[id] = h
+			histogramIDs = append(histogramIDs, id)
+			continue
+		}
+
+		valueType := prometheus.GaugeValue
+		switch sample.Type {
+		case "counter":
+			valueType = prometheus.CounterValue
+		case "untyped":
+			valueType = prometheus.UntypedValue
+		}
+		metric, err := prometheus.NewConstMetric(desc, valueType, sample.Value, labelValues...)
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "Skipping value", "metric", sample.Name, "path", sample.Path, "err", err)
+			continue
+		}
+		if !sample.Timestamp.IsZero() {
+			metric = prometheus.NewMetricWithTimestamp(sample.Timestamp, metric)
+		}
+		ch <- metric
+	}
+	for _, id := range histogramIDs {
+		h := histograms[id]
+		metric, err := h.metric()
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "Skipping value", "metric", h.name, "path", h.path, "err", err)
+			continue
+		}
+		ch <- metric
+	}
+}
+
+// constHistogram counts the observations of a histogram series into its
+// buckets, for a constant histogram.
+type constHistogram struct {
+	desc        *prometheus.Desc
+	name        string
+	path        string
+	labelValues []string
+	timestamp   time.Time
+	upperBounds []float64
+	buckets     map[float64]uint64
+	count       uint64
+	sum         float64
+}
+
+func newConstHistogram(desc *prometheus.Desc, sample Sample, labelValues []string) *constHistogram {
+	buckets := make(map[float64]uint64, len(sample.Buckets))
+	for _, upperBound := range sample.Buckets {
+		buckets[upperBound] = 0
+	}
+	return &constHistogram{
+		desc:        desc,
+		name:        sample.Name,
+		path:        sample.Path,
+		labelValues: labelValues,
+		timestamp:   sample.Timestamp,
+		upperBounds: sample.Buckets,
+		buckets:     buckets,
+	}
+}
+
+func (h *constHistogram) observe(value float64) {
+	h.count++
+	h.sum += value
+	for _, upperBound := range h.upperBounds {
+		if value <= upperBound {
+			h.buckets[upperBound]++
+		}
+	}
+}
+
+func (h *constHistogram) metric() (prometheus.Metric, error) {
+	metric, err := prometheus.NewConstHistogram(h.desc, h.count, h.sum, h.buckets, h.labelValues...)
+	if err != nil {
+		return nil, err
+	}
+	if !h.timestamp.IsZero() {
+		metric = prometheus.NewMetricWithTimestamp(h.timestamp, metric)
+	}
+	return metric, nil
+}
@@ -0,0 +1,76 @@
+package jsonwalk
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	fetch := func() (interface{}, error) {
+		var jsonData interface{}
+		err := json.Unmarshal([]byte(`{"requests": 10, "a-b": 1, "a_b": 2, "disks": [{"name": "sda", "used": 0.5}]}`), &jsonData)
+		return jsonData, err
+	}
+	opts := Options{LabelKeys: []string{"name"}, Separator: "_"}
+	opts.MetricTypes = []MetricTypeRule{{Type: "counter"}}
+	opts.MetricTypes[0].Path.Set("_requests$")
+
+	collector := NewCollector("app", fetch, opts, log.NewNopLogger())
+	expected := `# HELP app_a_b Retrieved value
+# TYPE app_a_b gauge
+app_a_b 1
+# HELP app_disks_used Retrieved value
+# TYPE app_disks_used gauge
+app_disks_used{name="sda"} 0.5
+# HELP app_requests Retrieved value
+# TYPE app_requests counter
+app_requests 10
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+}
+
+func TestCollectorHistogram(t *testing.T) {
+	fetch := func() (interface{}, error) {
+		var jsonData interface{}
+		err := json.Unmarshal([]byte(`{"latencies": [0.2, 0.7, 3], "up": 1}`), &jsonData)
+		return jsonData, err
+	}
+	opts := Options{MetricTypes: []MetricTypeRule{{Type: "histogram", Buckets: []float64{0.5, 1}}}}
+	opts.MetricTypes[0].Path.Set("^latencies$")
+
+	collector := NewCollector("", fetch, opts, log.NewNopLogger())
+	expected := `# HELP latencies Retrieved value
+# TYPE latencies histogram
+latencies_bucket{le="0.5"} 1
+latencies_bucket{le="1"} 2
+latencies_bucket{le="+Inf"} 3
+latencies_sum 3.9
+latencies_count 3
+# HELP up Retrieved value
+# TYPE up gauge
+up 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+}
+
+func TestCollectorFetchError(t *testing.T) {
+	collector := NewCollector("", func() (interface{}, error) {
+		return nil, errors.New("connection refused")
+	}, Options{}, nil)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	if _, err := registry.Gather(); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("Got: %v, expected error containing: connection refused", err)
+	}
+}
@@ -0,0 +1,577 @@
+package jsonwalk
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Options controls how a document is walked and its values exported. The
+// yaml tags match the exporter's module configuration.
+type Options struct {
+	// ParseNumericStrings exports strings such as "21.5" as if they were
+	// numbers. Strings that do not parse are still ignored.
+	ParseNumericStrings bool `yaml:"parse_numeric_strings"`
+	// NumericStringPath parses the strings whose path, before sanitizing,
+	// matches it like ParseNumericStrings, e.g. ^uptime$ for
+	// {"uptime": "12345"}, leaving the other strings alone.
+	NumericStringPath Regexp `yaml:"numeric_string_path"`
+	// ParseBoolStrings exports the strings found in BoolStrings, or in
+	// DefaultBoolStrings if it is nil, as 1 when they map to true and 0
+	// when they map to false. They are matched case-insensitively.
+	ParseBoolStrings bool            `yaml:"parse_bool_strings"`
+	BoolStrings      map[string]bool `yaml:"bool_strings"`
+	// ValueMaps export the strings whose path matches a rule as the number
+	// the rule maps them to, see ValueMapRule. The first matching rule
+	// applies, and strings it does not map are parsed as usual.
+	ValueMaps []ValueMapRule `yaml:"value_maps"`
+	// Separator joins the path segments of metric names. Empty means
+	// DefaultSeparator.
+	Separator string `yaml:"name_separator"`
+	// LowercaseNames lowercases the metric names built from paths, e.g.
+	// cpu::userTime becomes cpu::usertime. Names given by Rename are kept.
+	LowercaseNames bool `yaml:"lowercase_names"`
+	// ReplaceColons replaces the colons of the metric names built from
+	// paths with underscores, "::" with a single one, as colons are meant
+	// for recording rules, e.g. cpu::user_time becomes cpu_user_time.
+	// Names given by Rename are kept.
+	ReplaceColons bool `yaml:"replace_colons"`
+	// LabelKeys names keys whose string value identifies the objects of an
+	// array. An array element holding one of them is labeled with its value
+	// instead of its index, and adds no array_N segment to the metric name.
+	LabelKeys []string `yaml:"label_keys"`
+	// SkipNonFinite drops NaN and infinite values, e.g. from numbers out
+	// of range like 1e400 or numeric strings like "NaN", instead of
+	// exporting them.
+	SkipNonFinite bool `yaml:"skip_nonfinite"`
+	// MaxDepth stops the walk from descending into values nested deeper
+	// than this many levels. Zero means no limit.
+	MaxDepth int `yaml:"max_depth"`
+	// FailOnMaxDepth asks callers to fail the probe when MaxDepth skipped
+	// values, see Stats.DepthLimited, rather than only log a warning.
+	FailOnMaxDepth bool `yaml:"fail_on_max_depth"`
+	// FlattenDepth caps the number of nesting levels that name metrics.
+	// The keys of deeper objects become labels named after their level
+	// instead, e.g. with a depth of 1, {"disks": {"sda": {"used": 10}}}
+	// exports disks{level_2="sda",level_3="used"} 10, and deeper arrays
+	// add no array_N segment, their index labels telling the elements
+	// apart. Zero means no limit.
+	FlattenDepth int `yaml:"flatten_depth"`
+	// MaxArrayLength truncates arrays to their first MaxArrayLength
+	// elements. Zero means no limit.
+	MaxArrayLength int `yaml:"max_array_length"`
+	// IncludePath and ExcludePath filter metrics by the path they are named
+	// after, before sanitizing. When set, only paths matching IncludePath
+	// and not matching ExcludePath are exported.
+	IncludePath Regexp `yaml:"include_path"`
+	ExcludePath Regexp `yaml:"exclude_path"`
+	// MetricTypes choose the type of the metrics whose path matches them.
+	// The first matching rule applies, and metrics matching none are gauges.
+	MetricTypes []MetricTypeRule `yaml:"metric_types"`
+	// ParseTimestamps exports RFC3339 timestamps, or timestamps in
+	// TimestampLayout when set, as unix seconds.
+	ParseTimestamps bool   `yaml:"parse_timestamps"`
+	TimestampLayout string `yaml:"timestamp_layout"`
+	// TimestampKey names a key holding the time the other values of its
+	// object were measured at, as unix seconds or a timestamp like for
+	// ParseTimestamps. The samples of those values and of the objects
+	// nested in them carry that time instead of the scrape time. The key
+	// itself is not exported.
+	TimestampKey string `yaml:"timestamp_key"`
+	// Scale multiplies the values whose path matches a rule by its factor.
+	// The first matching rule applies.
+	Scale []ScaleRule `yaml:"scale"`
+	// Help describes the metrics whose path matches a rule. The first
+	// matching rule applies, and metrics matching none get DefaultHelp.
+	Help []HelpRule `yaml:"help"`
+	// Namespace and Subsystem are prepended to every metric name, joined
+	// with underscores, e.g. myapp_db_queries for the path queries with
+	// namespace myapp and subsystem db. Unlike a path prefix, they are
+	// never joined with Separator, and apply to names given by Rename too.
+	Namespace string `yaml:"namespace"`
+	Subsystem string `yaml:"subsystem"`
+	// AggregateArrays exports arrays of numbers as their count, sum, min,
+	// max and avg rather than a series per element. Other arrays are
+	// walked as usual.
+	AggregateArrays bool `yaml:"aggregate_arrays"`
+	// Aggregate summarizes the arrays of numbers whose path matches a
+	// rule, see AggregateRule. The first matching rule applies, and
+	// arrays matching none are left to AggregateArrays.
+	Aggregate []AggregateRule `yaml:"aggregate"`
+	// FlattenSingletons walks the element of arrays holding exactly one
+	// as if it were in place of the array, without an array_N segment or
+	// index label.
+	FlattenSingletons bool `yaml:"flatten_singletons"`
+	// PathIndexLabels prefixes the array_N_index labels with the path of
+	// their array, e.g. x_array_0_index, telling apart arrays at the same
+	// nesting level.
+	PathIndexLabels bool `yaml:"path_index_labels"`
+	// ObjectArrays export the arrays of objects whose path matches a rule
+	// as metrics labeled by fields of the objects, see ObjectArrayRule.
+	// The first matching rule applies.
+	ObjectArrays []ObjectArrayRule `yaml:"object_arrays"`
+	// ExportStrings exports the strings that are not otherwise parsed as
+	// info metrics of value 1, labeled with the string under the last
+	// segment of their path, see stringLabelName.
+	ExportStrings bool `yaml:"export_strings"`
+	// TrimStrings trims the white space around the strings ExportStrings
+	// exports, and SkipBlankStrings skips those holding only white space
+	// while exporting others as they are. Empty strings are never
+	// exported, so trimming skips blank strings too.
+	TrimStrings      bool `yaml:"trim_strings"`
+	SkipBlankStrings bool `yaml:"skip_blank_strings"`
+	// ExpectedPaths lists paths, including the prefix, that are exported
+	// with MissingValue when the document lacks them, so that their series
+	// do not disappear when a target leaves out an optional field.
+	ExpectedPaths []string `yaml:"expected_paths"`
+	// MissingValue is the value of missing ExpectedPaths. Nil means NaN.
+	MissingValue *float64 `yaml:"missing_value"`
+	// Rename names the metrics whose path matches a rule, see RenameRule.
+	// The first matching rule applies, and with RenameOnly, values whose
+	// path matches none are not exported.
+	Rename     []RenameRule `yaml:"rename"`
+	RenameOnly bool         `yaml:"rename_only"`
+}
+
+// RenameRule exports the values whose path matches Path as the metric Name
+// instead of the sanitized path, adding Labels. In Name and the label
+// values, $1 or ${1} is replaced with the first submatch of Path, $name
+// with the submatch or, failing that, the label called name. Labels
+// referenced this way are replaced by the new ones, e.g. a rule with path
+// ^nodes::array_0::cpu$, name node_cpu_usage and a label node set to
+// $array_0_index exports node_cpu_usage{node="0"} rather than
+// nodes::array_0::cpu{array_0_index="0"}.
+type RenameRule struct {
+	Path   Regexp            `yaml:"path"`
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+// ObjectArrayRule exports an array of objects whose path matches Path, like
+// [{"region": "us", "latency": 12}], as one metric per value field named
+// after the field, e.g. latency{region="us"} 12. The Labels fields label
+// the values of each object. Values lists the value fields, by default
+// every other field holding a number.
+type ObjectArrayRule struct {
+	Path   Regexp   `yaml:"path"`
+	Labels []string `yaml:"labels"`
+	Values []string `yaml:"values"`
+}
+
+// ValueMapRule exports the strings whose path matches Path, such as enum-like
+// states, as the number Values maps them to, e.g. green: 0, yellow: 1 and
+// red: 2 for a cluster health status. Like BoolStrings, strings are matched
+// case-insensitively.
+type ValueMapRule struct {
+	Path   Regexp             `yaml:"path"`
+	Values map[string]float64 `yaml:"values"`
+}
+
+// HelpRule sets the help text of the metrics whose path matches Path. In
+// Help, {path} is replaced with the path. A Unit, e.g. "seconds", is
+// appended to the metric name as a suffix unless it already ends with it.
+type HelpRule struct {
+	Path Regexp `yaml:"path"`
+	Help string `yaml:"help"`
+	Unit string `yaml:"unit"`
+}
+
+const DefaultHelp = "Retrieved value"
+
+// ScaleRule multiplies the values whose path matches Path by Factor, e.g. to
+// convert bytes to megabytes.
+type ScaleRule struct {
+	Path   Regexp  `yaml:"path"`
+	Factor float64 `yaml:"factor"`
+}
+
+// AggregateRule exports an array of numbers whose path matches Path, like
+// {"latencies": [12, 30]}, as the Functions of its elements rather than a
+// series per element, e.g. latencies::array_0_sum 42 for sum. The functions
+// are those of AggregateFunctions, all of them if Functions is empty.
+type AggregateRule struct {
+	Path      Regexp   `yaml:"path"`
+	Functions []string `yaml:"functions"`
+}
+
+// AggregateFunctions lists the functions of AggregateRule, which are also
+// the suffixes of the metric names of the aggregates.
+var AggregateFunctions = []string{"count", "sum", "min", "max", "avg"}
+
+// MetricTypeRule exports the values whose path matches Path as metrics of
+// Type, "gauge", "counter", "untyped" or "histogram". The values of
+// histograms are observations, counted into Buckets, or
+// prometheus.DefBuckets if empty: an array of numbers, like the raw
+// latencies of {"latencies": [0.2, 1.5]}, is observed element by element
+// into a histogram named after the array, with no array_N segment or index
+// label.
+type MetricTypeRule struct {
+	Path    Regexp    `yaml:"path"`
+	Type    string    `yaml:"type"`
+	Buckets []float64 `yaml:"buckets"`
+}
+
+const DefaultSeparator = "::"
+
+// DefaultBoolStrings are the strings exported by ParseBoolStrings when
+// BoolStrings is not set.
+var DefaultBoolStrings = map[string]bool{
+	"true":  true,
+	"false": false,
+	"yes":   true,
+	"no":    false,
+	"on":    true,
+	"off":   false,
+	"up":    true,
+	"down":  false,
+}
+
+// includes reports whether the metric for key passes IncludePath and
+// ExcludePath.
+func (opts Options) includes(key string) bool {
+	if opts.IncludePath.Regexp != nil && !opts.IncludePath.MatchString(key) {
+		return false
+	}
+	return opts.ExcludePath.Regexp == nil || !opts.ExcludePath.MatchString(key)
+}
+
+// parsesNumbers reports whether the string for key is parsed as a number.
+func (opts Options) parsesNumbers(key string) bool {
+	return opts.ParseNumericStrings || opts.NumericStringPath.Regexp != nil && opts.NumericStringPath.MatchString(key)
+}
+
+// parseString returns the value of a string when it is exported as a
+// number, parsing numbers when numeric is set.
+func (opts Options) parseString(s string, numeric bool) (float64, bool) {
+	if numeric {
+		n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		// Out of range numbers parse as +/-Inf or 0, which are exported
+		// like any other value.
+		if numErr, ok := err.(*strconv.NumError); err == nil || ok && numErr.Err == strconv.ErrRange {
+			return n, true
+		}
+	}
+	if opts.ParseBoolStrings {
+		if b, ok := opts.parseBool(s); ok {
+			if b {
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if opts.ParseTimestamps {
+		layout := opts.TimestampLayout
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		if t, err := time.Parse(layout, s); err == nil {
+			return float64(t.Unix()), true
+		}
+	}
+	return 0, false
+}
+
+// mapValue returns the number the first ValueMaps rule matching the path of
+// a string maps it to.
+func (opts Options) mapValue(key, s string) (float64, bool) {
+	for _, rule := range opts.ValueMaps {
+		if rule.Path.Regexp == nil || !rule.Path.MatchString(key) {
+			continue
+		}
+		s = strings.TrimSpace(s)
+		if n, ok := rule.Values[s]; ok {
+			return n, true
+		}
+		for k, n := range rule.Values {
+			if strings.EqualFold(k, s) {
+				return n, true
+			}
+		}
+		return 0, false
+	}
+	return 0, false
+}
+
+// parseBool looks s up in BoolStrings, or DefaultBoolStrings if it is nil.
+func (opts Options) parseBool(s string) (bool, bool) {
+	boolStrings := opts.BoolStrings
+	if boolStrings == nil {
+		boolStrings = DefaultBoolStrings
+	}
+	s = strings.TrimSpace(s)
+	if b, ok := boolStrings[s]; ok {
+		return b, true
+	}
+	for k, b := range boolStrings {
+		if strings.EqualFold(k, s) {
+			return b, true
+		}
+	}
+	return false, false
+}
+
+// parseTimestamp returns the time held by a TimestampKey value.
+func (opts Options) parseTimestamp(x interface{}) (time.Time, bool) {
+	var seconds float64
+	switch v := x.(type) {
+	case float64:
+		seconds = v
+	case json.Number:
+		n, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		seconds = n
+	case string:
+		layout := opts.TimestampLayout
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, true
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		seconds = n
+	default:
+		return time.Time{}, false
+	}
+	if math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return time.Time{}, false
+	}
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
+
+// missingValue returns the value exported for missing ExpectedPaths.
+func (opts Options) missingValue() float64 {
+	if opts.MissingValue == nil {
+		return math.NaN()
+	}
+	return *opts.MissingValue
+}
+
+// exportedString returns the label value ExportStrings exports for s, and
+// whether to export it at all.
+func (opts Options) exportedString(s string) (string, bool) {
+	if opts.TrimStrings {
+		s = strings.TrimSpace(s)
+	} else if opts.SkipBlankStrings && strings.TrimSpace(s) == "" {
+		return "", false
+	}
+	return s, s != ""
+}
+
+// stringLabelName returns the name of the label holding a string exported
+// by ExportStrings at path, its last segment other than array_N, e.g.
+// version for build::version and tags for tags::array_0.
+func (opts Options) stringLabelName(path string) string {
+	sep := opts.separator()
+	for {
+		trimmed := strings.TrimRight(path, "0123456789")
+		if trimmed == path || trimmed != "array_" && !strings.HasSuffix(trimmed, sep+"array_") {
+			break
+		}
+		path = strings.TrimSuffix(strings.TrimSuffix(trimmed, "array_"), sep)
+	}
+	if i := strings.LastIndex(path, sep); i >= 0 {
+		path = path[i+len(sep):]
+	}
+	if path == "" {
+		return "value"
+	}
+	return SanitizeLabelName(path)
+}
+
+// objectArrayRule returns the first ObjectArrays rule matching the path of
+// an array.
+func (opts Options) objectArrayRule(path string) (ObjectArrayRule, bool) {
+	for _, rule := range opts.ObjectArrays {
+		if rule.Path.Regexp != nil && rule.Path.MatchString(path) {
+			return rule, true
+		}
+	}
+	return ObjectArrayRule{}, false
+}
+
+// aggregateFunctions returns the functions summarizing the array at path,
+// reporting false when its elements are exported on their own.
+func (opts Options) aggregateFunctions(path string) ([]string, bool) {
+	for _, rule := range opts.Aggregate {
+		if rule.Path.Regexp != nil && rule.Path.MatchString(path) {
+			if len(rule.Functions) == 0 {
+				return AggregateFunctions, true
+			}
+			return rule.Functions, true
+		}
+	}
+	if opts.AggregateArrays {
+		return AggregateFunctions, true
+	}
+	return nil, false
+}
+
+// metricType returns the type of the metric for key, and the buckets of
+// histograms.
+func (opts Options) metricType(key string) (string, []float64) {
+	for _, rule := range opts.MetricTypes {
+		if rule.Path.Regexp != nil && rule.Path.MatchString(key) {
+			if rule.Type == "histogram" && len(rule.Buckets) == 0 {
+				return rule.Type, prometheus.DefBuckets
+			}
+			return rule.Type, rule.Buckets
+		}
+	}
+	return "gauge", nil
+}
+
+// scale applies the first matching scale rule for key to value.
+func (opts Options) scale(key string, value float64) float64 {
+	for _, rule := range opts.Scale {
+		if rule.Path.Regexp != nil && rule.Path.MatchString(key) {
+			return value * rule.Factor
+		}
+	}
+	return value
+}
+
+// rename returns the metric name and labels for key, the path of a value
+// before sanitizing, holding labels. It reports false when RenameOnly drops
+// the value.
+func (opts Options) rename(key string, labels []Label) (string, []Label, bool) {
+	for _, rule := range opts.Rename {
+		if rule.Path.Regexp == nil {
+			continue
+		}
+		submatches := rule.Path.FindStringSubmatch(key)
+		if submatches == nil {
+			continue
+		}
+		moved := map[string]bool{}
+		expand := func(template string) string {
+			return os.Expand(template, func(name string) string {
+				if i, err := strconv.Atoi(name); err == nil {
+					if i < len(submatches) {
+						return submatches[i]
+					}
+					return ""
+				}
+				if i := rule.Path.SubexpIndex(name); i >= 0 {
+					return submatches[i]
+				}
+				for _, label := range labels {
+					if label.Name == name {
+						moved[name] = true
+						return label.Value
+					}
+				}
+				return ""
+			})
+		}
+
+		name := SanitizeName(expand(rule.Name))
+		labelNames := make([]string, 0, len(rule.Labels))
+		for labelName := range rule.Labels {
+			labelNames = append(labelNames, labelName)
+		}
+		sort.Strings(labelNames)
+		added := make([]Label, len(labelNames))
+		for i, labelName := range labelNames {
+			added[i] = Label{Name: labelName, Value: expand(rule.Labels[labelName])}
+		}
+		renamed := make([]Label, 0, len(labels)+len(added))
+		for _, label := range labels {
+			if !moved[label.Name] {
+				renamed = append(renamed, label)
+			}
+		}
+		return name, append(renamed, added...), true
+	}
+	if opts.RenameOnly {
+		return "", nil, false
+	}
+	name := SanitizeName(key)
+	if opts.LowercaseNames {
+		name = strings.ToLower(name)
+	}
+	if opts.ReplaceColons {
+		name = strings.ReplaceAll(strings.ReplaceAll(name, "::", "_"), ":", "_")
+	}
+	return name, labels, true
+}
+
+// describe returns the metric name and help text for key, which is the
+// path of a value before sanitizing, named name by rename.
+func (opts Options) describe(key, name string) (string, string) {
+	for _, rule := range opts.Help {
+		if rule.Path.Regexp == nil || !rule.Path.MatchString(key) {
+			continue
+		}
+		if rule.Unit != "" && !strings.HasSuffix(name, "_"+rule.Unit) {
+			name += "_" + rule.Unit
+		}
+		if rule.Help == "" {
+			return name, DefaultHelp
+		}
+		return name, strings.ReplaceAll(rule.Help, "{path}", key)
+	}
+	return name, DefaultHelp
+}
+
+// qualify prepends Namespace and Subsystem to a metric name.
+func (opts Options) qualify(name string) string {
+	for _, part := range []string{opts.Subsystem, opts.Namespace} {
+		if part != "" {
+			name = part + "_" + name
+		}
+	}
+	return name
+}
+
+func (opts Options) separator() string {
+	if opts.Separator == "" {
+		return DefaultSeparator
+	}
+	return opts.Separator
+}
+
+// Regexp is a regular expression that can be set by a flag or in YAML. The
+// zero value matches nothing and means the filter is unset.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+// Set implements flag.Value.
+func (re *Regexp) Set(s string) error {
+	compiled, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	re.Regexp = compiled
+	return nil
+}
+
+func (re *Regexp) String() string {
+	if re == nil || re.Regexp == nil {
+		return ""
+	}
+	return re.Regexp.String()
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return re.Set(s)
+}
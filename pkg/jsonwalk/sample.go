@@ -0,0 +1,159 @@
+package jsonwalk
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// SanitizeName turns key into a valid Prometheus metric name by replacing
+// every character outside [a-zA-Z0-9_:] with an underscore and prefixing an
+// underscore when it starts with a digit.
+func SanitizeName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, key)
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		return "_" + name
+	}
+	return name
+}
+
+// SanitizeLabelName is like SanitizeName, but also replaces colons which are
+// reserved in label names.
+func SanitizeLabelName(key string) string {
+	return strings.ReplaceAll(SanitizeName(key), ":", "_")
+}
+
+// Sample is a value found by WalkPath, named, typed and scaled for export.
+type Sample struct {
+	// Path is the path of the value before sanitizing, as matched by
+	// IncludePath and the other path rules.
+	Path string
+	// Name is the metric name, and Type "gauge", "counter", "untyped" or
+	// "histogram". The samples of a histogram series are its observations,
+	// counted into Buckets.
+	Name    string
+	Help    string
+	Type    string
+	Buckets []float64
+	Labels  []Label
+	Value   float64
+	// Timestamp is the time the value was measured at, from TimestampKey.
+	// Zero means the scrape time.
+	Timestamp time.Time
+}
+
+// NewSample prepares the value found at the path key for export. The
+// returned reason is set when the value is not to be exported.
+func (opts Options) NewSample(key string, value float64, labels []Label) (Sample, string) {
+	if !opts.includes(key) {
+		return Sample{Path: key}, "excluded by include_path or exclude_path"
+	}
+	name, labels, ok := opts.rename(key, labels)
+	if !ok {
+		return Sample{Path: key}, "matched by no rename rule"
+	}
+	name, help := opts.describe(key, name)
+	metricType, buckets := opts.metricType(key)
+	sample := Sample{Path: key, Name: opts.qualify(name), Help: help, Type: metricType, Buckets: buckets, Labels: labels, Value: opts.scale(key, value)}
+	if opts.SkipNonFinite && (math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0)) {
+		return sample, "non-finite value"
+	}
+	if sample.Type == "counter" && sample.Value < 0 {
+		return sample, "negative counter value"
+	}
+	return sample, ""
+}
+
+// Collect walks the document jsonData found at path, e.g. a metric name
+// prefix, and returns the samples to export in the order they were found,
+// followed by the missing ExpectedPaths. Values not to be exported are
+// logged at debug level.
+func Collect(path string, jsonData interface{}, opts Options, logger log.Logger) ([]Sample, Stats) {
+	var samples []Sample
+	seen := map[string]bool{}
+	w := newWalker(path, nil, opts, logger)
+	receiver := ReceiverFunc(func(key string, value float64, labels []Label) {
+		seen[key] = true
+		sample, skipped := opts.NewSample(key, value, labels)
+		if skipped != "" {
+			level.Debug(logger).Log("msg", "Skipping value", "path", key, "value", value, "reason", skipped)
+			return
+		}
+		sample.Timestamp = w.timestamp
+		samples = append(samples, sample)
+	})
+	w.receiver = receiver
+	w.walk(path, jsonData, []Label{}, 0, 0)
+
+	for _, path := range opts.ExpectedPaths {
+		if !seen[path] {
+			level.Debug(logger).Log("msg", "Expected path is missing", "path", path)
+			receiver(path, opts.missingValue(), []Label{})
+		}
+	}
+	return samples, w.stats
+}
+
+// Walk returns the samples to export for the document jsonData.
+func Walk(jsonData interface{}, opts Options) []Sample {
+	samples, _ := Collect("", jsonData, opts, log.NewNopLogger())
+	return samples
+}
+
+// Value converts a JSON scalar to a sample value the way WalkPath does. As
+// x has no path, NumericStringPath and ValueMaps do not apply.
+func Value(x interface{}, opts Options) (float64, bool) {
+	var value float64
+	switch v := x.(type) {
+	case float64:
+		value = v
+	case json.Number:
+		n, err := parseNumber(v)
+		if err != nil {
+			return 0, false
+		}
+		value = n
+	case bool:
+		if v {
+			value = 1.0
+		}
+	case string:
+		n, ok := opts.parseString(v, opts.ParseNumericStrings)
+		if !ok {
+			return 0, false
+		}
+		value = n
+	default:
+		return 0, false
+	}
+	if opts.SkipNonFinite && (math.IsNaN(value) || math.IsInf(value, 0)) {
+		return 0, false
+	}
+	return value, true
+}
+
+// LabelValue formats a JSON scalar as a label value.
+func LabelValue(x interface{}) string {
+	switch v := x.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return ""
+	}
+}
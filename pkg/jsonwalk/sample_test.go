@@ -0,0 +1,206 @@
+package jsonwalk
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestWalk(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"requests": {"total": 10, "errors": -1}, "disks": [{"name": "sda", "used": 0.5}], "state": "up"}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	opts := Options{LabelKeys: []string{"name"}}
+	opts.MetricTypes = []MetricTypeRule{{Type: "counter"}}
+	opts.MetricTypes[0].Path.Set("^requests::")
+	opts.Help = []HelpRule{{Help: "Used share of {path}", Unit: "ratio"}}
+	opts.Help[0].Path.Set("used$")
+
+	expected := []Sample{
+		{Path: "disks::used", Name: "disks::used_ratio", Help: "Used share of disks::used", Type: "gauge", Labels: []Label{{Name: "name", Value: "sda"}}, Value: 0.5},
+		{Path: "requests::total", Name: "requests::total", Help: DefaultHelp, Type: "counter", Labels: []Label{}, Value: 10},
+	}
+	if actual := Walk(jsonData, opts); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got: %+v, expected: %+v", actual, expected)
+	}
+}
+
+func TestWalkLowercaseNames(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"CPU": {"userTime": 1}, "Load-Avg": 2, "Mem": 3}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	opts := Options{LowercaseNames: true}
+	opts.Rename = []RenameRule{{Name: "Memory_Bytes"}}
+	opts.Rename[0].Path.Set("^Mem$")
+
+	var actual []string
+	for _, sample := range Walk(jsonData, opts) {
+		actual = append(actual, sample.Name)
+	}
+	expected := []string{"cpu::usertime", "load_avg", "Memory_Bytes"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got: %v, expected: %v", actual, expected)
+	}
+}
+
+func TestWalkReplaceColons(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"cpu": {"user:time": 1}, "load": 2, "Mem": 3}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	opts := Options{ReplaceColons: true}
+	opts.Rename = []RenameRule{{Name: "mem:bytes"}}
+	opts.Rename[0].Path.Set("^Mem$")
+
+	var actual []string
+	for _, sample := range Walk(jsonData, opts) {
+		actual = append(actual, sample.Name)
+	}
+	expected := []string{"mem:bytes", "cpu_user_time", "load"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got: %v, expected: %v", actual, expected)
+	}
+}
+
+func TestWalkNamespace(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"queries": 1, "latency": 2, "up": 3}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	opts := Options{Namespace: "myapp", Subsystem: "db"}
+	opts.Help = []HelpRule{{Help: "Query latency", Unit: "seconds"}}
+	opts.Help[0].Path.Set("^latency$")
+	opts.Rename = []RenameRule{{Name: "ready"}}
+	opts.Rename[0].Path.Set("^up$")
+
+	var actual []string
+	for _, sample := range Walk(jsonData, opts) {
+		actual = append(actual, sample.Name+" "+sample.Help)
+	}
+	sort.Strings(actual)
+	expected := []string{"myapp_db_latency_seconds Query latency", "myapp_db_queries Retrieved value", "myapp_db_ready Retrieved value"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got: %v, expected: %v", actual, expected)
+	}
+
+	opts = Options{Subsystem: "db"}
+	if actual := opts.qualify("queries"); actual != "db_queries" {
+		t.Errorf("Got: %v, expected: db_queries", actual)
+	}
+}
+
+func TestCollectExpectedPaths(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"ok": 1}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	samples, stats := Collect("app", jsonData, Options{ExpectedPaths: []string{"app::ok", "app::failed"}}, log.NewNopLogger())
+	if len(samples) != 2 || samples[0].Name != "app::ok" || samples[1].Name != "app::failed" || !math.IsNaN(samples[1].Value) {
+		t.Errorf("Got: %+v, expected app::ok and a NaN app::failed", samples)
+	}
+	if stats.MaxDepth != 1 {
+		t.Errorf("Got max depth: %d, expected: 1", stats.MaxDepth)
+	}
+}
+
+func TestCollectDepthLimited(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"x": 1, "y": {"z": {"w": 2}}, "v": [{"u": [3]}]}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	testData := []struct {
+		name     string
+		opts     Options
+		expected bool
+	}{
+		{name: "no limit", expected: false},
+		{name: "within limit", opts: Options{MaxDepth: 4}, expected: false},
+		{name: "exceeded", opts: Options{MaxDepth: 2}, expected: true},
+		{name: "exceeded in object array", opts: Options{MaxDepth: 1, ObjectArrays: []ObjectArrayRule{{Values: []string{"u"}}}}, expected: true},
+	}
+	testData[3].opts.ObjectArrays[0].Path.Set("^v$")
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			_, stats := Collect("", jsonData, tt.opts, log.NewNopLogger())
+			if stats.DepthLimited != tt.expected {
+				t.Errorf("Got: %v, expected: %v", stats.DepthLimited, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkRename(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"nodes": [{"cpu": 0.5, "mem": 2}], "disks": {"sda": {"used": 10}}, "uptime": 3}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	rules := []RenameRule{
+		{Name: "node_cpu_usage", Labels: map[string]string{"node": "$array_0_index"}},
+		{Name: "disk_${1}_bytes", Labels: map[string]string{"device": "${device}", "source": "json"}},
+	}
+	rules[0].Path.Set("^nodes::array_0::cpu$")
+	rules[1].Path.Set("^disks::(?P<device>[^:]+)::(\\w+)$")
+
+	testData := []struct {
+		name     string
+		only     bool
+		expected []string
+	}{
+		{
+			name: "unmatched paths pass through",
+			expected: []string{
+				"disk_sda_bytes{device=sda,source=json} 10",
+				"node_cpu_usage{node=0} 0.5",
+				"nodes::array_0::mem{array_0_index=0} 2",
+				"uptime{} 3",
+			},
+		},
+		{
+			name: "unmatched paths dropped",
+			only: true,
+			expected: []string{
+				"disk_sda_bytes{device=sda,source=json} 10",
+				"node_cpu_usage{node=0} 0.5",
+			},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var actual []string
+			for _, sample := range Walk(jsonData, Options{Rename: rules, RenameOnly: tt.only}) {
+				pairs := make([]string, len(sample.Labels))
+				for i, label := range sample.Labels {
+					pairs[i] = label.Name + "=" + label.Value
+				}
+				actual = append(actual, fmt.Sprintf("%s{%s} %v", sample.Name, strings.Join(pairs, ","), sample.Value))
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
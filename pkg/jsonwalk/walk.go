@@ -0,0 +1,443 @@
+// Package jsonwalk turns JSON documents into Prometheus samples, naming each
+// value after its path in the document. It is the walk behind the
+// exporter's /probe endpoint, usable with any registry or HTTP plumbing.
+//
+// Documents are the values encoding/json decodes into an interface{}, with
+// numbers as float64 or, better, json.Number, which keeps integers too
+// large for a float64 detectable.
+package jsonwalk
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Label is a label name and value attached to a value found by WalkPath.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// ReceiverFunc adapts a function to a Receiver.
+type ReceiverFunc func(key string, value float64, labels []Label)
+
+func (receiver ReceiverFunc) Receive(key string, value float64, labels []Label) {
+	receiver(key, value, labels)
+}
+
+// Receiver is handed every value found by WalkPath, along with its path
+// before sanitizing and its labels.
+type Receiver interface {
+	Receive(key string, value float64, labels []Label)
+}
+
+// Stats summarises the shape of a document visited by WalkPath.
+type Stats struct {
+	// MaxDepth is the deepest nesting level reached, counting every object
+	// and array on the way down as one level.
+	MaxDepth int
+	// ValueTypes counts the values encountered by JSON type, see ValueTypes.
+	ValueTypes map[string]int
+	// TruncatedArrays counts the arrays cut short by MaxArrayLength.
+	TruncatedArrays int
+	// DepthLimited is set when values nested deeper than MaxDepth were
+	// skipped.
+	DepthLimited bool
+}
+
+// ValueTypes lists the JSON value types counted in Stats.ValueTypes.
+var ValueTypes = []string{"float", "int", "bool", "string", "null", "array", "object"}
+
+type walker struct {
+	opts     Options
+	receiver Receiver
+	stats    Stats
+	logger   log.Logger
+	// root is the path the walk started at, e.g. a metric name prefix.
+	root string
+	// timestamp is the time of the values being walked, from the
+	// TimestampKey of the closest enclosing object that has one.
+	timestamp time.Time
+}
+
+// WalkPath visits the document jsonData found at path, e.g. a metric name
+// prefix, passing its values to receiver. Most callers want Collect or Walk
+// instead, which also apply the options naming and filtering the values.
+func WalkPath(path string, jsonData interface{}, labels []Label, receiver Receiver, opts Options, logger log.Logger) Stats {
+	w := newWalker(path, receiver, opts, logger)
+	w.walk(path, jsonData, labels, 0, 0)
+	return w.stats
+}
+
+func newWalker(path string, receiver Receiver, opts Options, logger log.Logger) *walker {
+	return &walker{
+		opts:     opts,
+		receiver: receiver,
+		stats:    Stats{ValueTypes: map[string]int{}},
+		logger:   logger,
+		root:     path,
+	}
+}
+
+// tooDeep reports whether values at depth are nested deeper than MaxDepth,
+// warning the first time the walk skips some.
+func (w *walker) tooDeep(path string, depth int) bool {
+	if w.opts.MaxDepth == 0 || depth <= w.opts.MaxDepth {
+		return false
+	}
+	if !w.stats.DepthLimited {
+		level.Warn(w.logger).Log("msg", "Maximum depth reached, skipping deeper values", "max_depth", w.opts.MaxDepth, "path", path)
+		w.stats.DepthLimited = true
+	}
+	return true
+}
+
+// walk visits jsonData found at path. arrays counts the arrays enclosing
+// it, which numbers the array_N segments and index labels.
+func (w *walker) walk(path string, jsonData interface{}, labels []Label, arrays int, depth int) {
+	if w.tooDeep(path, depth) {
+		return
+	}
+	if depth > w.stats.MaxDepth {
+		w.stats.MaxDepth = depth
+	}
+	switch v := jsonData.(type) {
+	case int:
+		w.stats.ValueTypes["int"]++
+		w.receiver.Receive(path, float64(v), labels)
+	case json.Number:
+		if n, ok := w.number(path, v); ok {
+			w.countNumber(v)
+			w.receiver.Receive(path, n, labels)
+		}
+	case float64:
+		w.countNumber(v)
+		w.receiver.Receive(path, v, labels)
+	case bool:
+		w.stats.ValueTypes["bool"]++
+		n := 0.0
+		if v {
+			n = 1.0
+		}
+		w.receiver.Receive(path, n, labels)
+	case string:
+		w.stats.ValueTypes["string"]++
+		if n, ok := w.opts.mapValue(path, v); ok {
+			w.receiver.Receive(path, n, labels)
+		} else if n, ok := w.opts.parseString(v, w.opts.parsesNumbers(path)); ok {
+			w.receiver.Receive(path, n, labels)
+		} else if value, ok := w.opts.exportedString(v); ok && w.opts.ExportStrings {
+			label := Label{Name: w.opts.stringLabelName(path), Value: value}
+			w.receiver.Receive(path, 1, withLabel(labels, label))
+		}
+	case nil:
+		w.stats.ValueTypes["null"]++
+	case []interface{}:
+		w.stats.ValueTypes["array"]++
+		prefix := ""
+		if path != "" {
+			prefix = path + w.opts.separator()
+		}
+		if metricType, _ := w.opts.metricType(path); metricType == "histogram" && w.observe(path, v, labels, depth+1) {
+			return
+		}
+		if rule, ok := w.opts.objectArrayRule(path); ok && w.objectArray(path, v, labels, rule, depth+1) {
+			return
+		}
+		if w.opts.FlattenSingletons && len(v) == 1 {
+			w.walk(path, v[0], labels, arrays, depth+1)
+			return
+		}
+		if functions, ok := w.opts.aggregateFunctions(path); ok && w.aggregate(fmt.Sprintf("%sarray_%d", prefix, arrays), v, labels, depth+1, functions) {
+			return
+		}
+		if w.opts.MaxArrayLength > 0 && len(v) > w.opts.MaxArrayLength {
+			level.Warn(w.logger).Log("msg", "Truncating array", "path", path, "length", len(v), "max_array_length", w.opts.MaxArrayLength)
+			w.stats.TruncatedArrays++
+			v = v[:w.opts.MaxArrayLength]
+		}
+		for i, x := range v {
+			if element, label, ok := w.labelElement(x); ok {
+				w.walk(path, element, withLabel(labels, label), arrays+1, depth+1)
+				continue
+			}
+			label := Label{Name: w.indexLabelName(path, arrays), Value: strconv.Itoa(i)}
+			if w.flattened(depth + 1) {
+				w.walk(path, x, withLabel(labels, label), arrays+1, depth+1)
+				continue
+			}
+			w.walk(fmt.Sprintf("%sarray_%d", prefix, arrays), x, withLabel(labels, label), arrays+1, depth+1)
+		}
+	case map[string]interface{}:
+		w.stats.ValueTypes["object"]++
+		prefix := ""
+		if path != "" {
+			prefix = strings.ReplaceAll(path, "-", "_") + w.opts.separator()
+		}
+		// Walk keys in order so metrics are registered the same way on
+		// every probe.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if x, ok := v[w.opts.TimestampKey]; ok && w.opts.TimestampKey != "" {
+			if t, ok := w.opts.parseTimestamp(x); ok {
+				defer func(t time.Time) { w.timestamp = t }(w.timestamp)
+				w.timestamp = t
+			} else {
+				level.Warn(w.logger).Log("msg", "Invalid timestamp, keeping the enclosing one", "path", prefix+w.opts.TimestampKey, "value", fmt.Sprintf("%v", x))
+			}
+		}
+		for _, k := range keys {
+			if k == w.opts.TimestampKey {
+				continue
+			}
+			if w.flattened(depth + 1) {
+				label := Label{Name: fmt.Sprintf("level_%d", depth+1), Value: k}
+				w.walk(path, v[k], withLabel(labels, label), arrays, depth+1)
+				continue
+			}
+			w.walk(fmt.Sprintf("%s%s", prefix, k), v[k], labels, arrays, depth+1)
+		}
+	default:
+		level.Warn(w.logger).Log("msg", "Unknown type", "path", path, "value", fmt.Sprintf("%#v", v))
+	}
+}
+
+// flattened reports whether values at depth are past FlattenDepth, their
+// keys becoming labels rather than segments of the metric name.
+func (w *walker) flattened(depth int) bool {
+	return w.opts.FlattenDepth > 0 && depth > w.opts.FlattenDepth
+}
+
+// indexLabelName returns the name of the label holding the index of the
+// elements of the array at path, the arrays-th array on the way down.
+func (w *walker) indexLabelName(path string, arrays int) string {
+	name := fmt.Sprintf("array_%d_index", arrays)
+	if w.opts.PathIndexLabels && path != "" {
+		return SanitizeLabelName(path) + "_" + name
+	}
+	return name
+}
+
+// objectArray exports an array holding only objects as one metric per
+// value field, named after the field alone and labeled with the label
+// fields of each object. It reports false, exporting nothing, for any other
+// array.
+func (w *walker) objectArray(path string, values []interface{}, labels []Label, rule ObjectArrayRule, depth int) bool {
+	objects := make([]map[string]interface{}, len(values))
+	for i, x := range values {
+		object, ok := x.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		objects[i] = object
+	}
+	if w.tooDeep(path, depth) {
+		return true
+	}
+
+	isLabel := map[string]bool{}
+	for _, field := range rule.Labels {
+		isLabel[field] = true
+	}
+	for _, object := range objects {
+		w.stats.ValueTypes["object"]++
+		objectLabels := labels
+		for _, field := range rule.Labels {
+			objectLabels = withLabel(objectLabels, Label{Name: SanitizeLabelName(field), Value: LabelValue(object[field])})
+		}
+		fields := rule.Values
+		if len(fields) == 0 {
+			for field := range object {
+				if !isLabel[field] {
+					fields = append(fields, field)
+				}
+			}
+			sort.Strings(fields)
+		}
+		for _, field := range fields {
+			value, ok := Value(object[field], w.opts)
+			if !ok {
+				continue
+			}
+			name := field
+			if w.root != "" {
+				name = w.root + w.opts.separator() + field
+			}
+			w.receiver.Receive(name, value, objectLabels)
+		}
+	}
+	return true
+}
+
+// number converts the JSON number at path to a float64, logging integers
+// that cannot be represented exactly.
+func (w *walker) number(path string, n json.Number) (float64, bool) {
+	f, err := parseNumber(n)
+	if err != nil {
+		level.Warn(w.logger).Log("msg", "Invalid number", "path", path, "err", err)
+		return 0, false
+	}
+	if lossyInteger(n, f) {
+		level.Debug(w.logger).Log("msg", "Integer loses precision as a float64", "path", path, "value", n, "exported", f)
+	}
+	return f, true
+}
+
+// aggregate exports the functions, of AggregateFunctions, of an array
+// holding only numbers under path, instead of a series per element. It
+// reports false, exporting nothing, for any other array.
+func (w *walker) aggregate(path string, values []interface{}, labels []Label, depth int, functions []string) bool {
+	if len(values) == 0 {
+		return false
+	}
+	numbers, ok := w.numbers(path, values)
+	if !ok {
+		return false
+	}
+	if w.tooDeep(path, depth) {
+		return true
+	}
+
+	for _, x := range values {
+		w.countNumber(x)
+	}
+	sum, min, max := 0.0, math.Inf(1), math.Inf(-1)
+	for _, n := range numbers {
+		sum += n
+		min = math.Min(min, n)
+		max = math.Max(max, n)
+	}
+	aggregates := map[string]float64{
+		"count": float64(len(numbers)),
+		"sum":   sum,
+		"min":   min,
+		"max":   max,
+		"avg":   sum / float64(len(numbers)),
+	}
+	for _, function := range functions {
+		w.receiver.Receive(path+"_"+function, aggregates[function], labels)
+	}
+	return true
+}
+
+// observe passes each element of an array holding only numbers to the
+// receiver under path, the observations of a histogram. It reports false,
+// passing nothing, for any other array.
+func (w *walker) observe(path string, values []interface{}, labels []Label, depth int) bool {
+	numbers, ok := w.numbers(path, values)
+	if !ok {
+		return false
+	}
+	if w.tooDeep(path, depth) {
+		return true
+	}
+	for i, n := range numbers {
+		w.countNumber(values[i])
+		w.receiver.Receive(path, n, labels)
+	}
+	return true
+}
+
+// numbers converts the elements of an array holding only numbers, found at
+// path, to float64s. It reports false for any other array.
+func (w *walker) numbers(path string, values []interface{}) ([]float64, bool) {
+	numbers := make([]float64, len(values))
+	for i, x := range values {
+		switch v := x.(type) {
+		case float64:
+			numbers[i] = v
+		case json.Number:
+			n, ok := w.number(path, v)
+			if !ok {
+				return nil, false
+			}
+			numbers[i] = n
+		default:
+			return nil, false
+		}
+	}
+	return numbers, true
+}
+
+// countNumber counts x, a float64 or json.Number, in the int or float
+// value types of the stats. A json.Number is an int when written without a
+// fraction or exponent, so that 1.0 is a float; a float64 no longer tells,
+// so it is an int when it has no fractional part.
+func (w *walker) countNumber(x interface{}) {
+	isInt := false
+	switch v := x.(type) {
+	case json.Number:
+		isInt = !strings.ContainsAny(string(v), ".eE")
+	case float64:
+		isInt = v == math.Trunc(v)
+	}
+	if isInt {
+		w.stats.ValueTypes["int"]++
+	} else {
+		w.stats.ValueTypes["float"]++
+	}
+}
+
+// labelElement checks whether the array element x is an object holding one
+// of the configured label keys with a string value. If so it returns the
+// label and the object without that key.
+func (w *walker) labelElement(x interface{}) (map[string]interface{}, Label, bool) {
+	object, ok := x.(map[string]interface{})
+	if !ok {
+		return nil, Label{}, false
+	}
+	for _, key := range w.opts.LabelKeys {
+		value, ok := object[key].(string)
+		if !ok {
+			continue
+		}
+		element := make(map[string]interface{}, len(object)-1)
+		for k, v := range object {
+			if k != key {
+				element[k] = v
+			}
+		}
+		return element, Label{Name: SanitizeLabelName(key), Value: value}, true
+	}
+	return nil, Label{}, false
+}
+
+func withLabel(labels []Label, label Label) []Label {
+	next := make([]Label, len(labels)+1)
+	copy(next, labels)
+	next[len(labels)] = label
+	return next
+}
+
+// parseNumber converts a JSON number to a float64. Numbers out of range
+// become +/-Inf, like numeric strings.
+func parseNumber(n json.Number) (float64, error) {
+	f, err := strconv.ParseFloat(string(n), 64)
+	if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+		return f, nil
+	}
+	return f, err
+}
+
+// lossyInteger reports whether n is an integer that f, its float64
+// conversion, does not represent exactly, as happens above 2^53.
+func lossyInteger(n json.Number, f float64) bool {
+	i, ok := new(big.Int).SetString(string(n), 10)
+	if !ok || math.IsInf(f, 0) {
+		return false
+	}
+	exact, _ := big.NewFloat(f).Int(nil)
+	return i.Cmp(exact) != 0
+}
@@ -0,0 +1,535 @@
+package jsonwalk
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestWalkPathLargeNumbers(t *testing.T) {
+	decoder := json.NewDecoder(strings.NewReader(`{"a": 9007199254740993, "b": 1700000000123456789, "c": 1.5, "d": 1e400, "e": [9007199254740993], "f": 1.0}`))
+	decoder.UseNumber()
+	var jsonData interface{}
+	if err := decoder.Decode(&jsonData); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	values := map[string]float64{}
+	stats := WalkPath("", jsonData, nil, ReceiverFunc(func(key string, value float64, labels []Label) {
+		values[key] = value
+	}), Options{}, log.NewNopLogger())
+
+	expected := map[string]float64{
+		"a":          9007199254740992,
+		"b":          1700000000123456768,
+		"c":          1.5,
+		"d":          math.Inf(1),
+		"e::array_0": 9007199254740992,
+		"f":          1,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Got: %v, expected: %v", values, expected)
+	}
+	if stats.ValueTypes["int"] != 3 || stats.ValueTypes["float"] != 3 {
+		t.Errorf("Got: %v, expected 3 ints and 3 floats", stats.ValueTypes)
+	}
+}
+
+func TestLossyInteger(t *testing.T) {
+	testData := []struct {
+		number   json.Number
+		expected bool
+	}{
+		{number: "9007199254740992", expected: false},
+		{number: "9007199254740993", expected: true},
+		{number: "-9007199254740993", expected: true},
+		{number: "18446744073709551616", expected: false},
+		{number: "18446744073709551617", expected: true},
+		{number: "1.5", expected: false},
+		{number: "1e400", expected: false},
+	}
+
+	for _, tt := range testData {
+		t.Run(string(tt.number), func(t *testing.T) {
+			f, err := parseNumber(tt.number)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if actual := lossyInteger(tt.number, f); actual != tt.expected {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkPathAggregateArrays(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"x": [1, 2, 6], "y": [1, {"z": 2}], "e": []}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	values := map[string]float64{}
+	WalkPath("", jsonData, nil, ReceiverFunc(func(key string, value float64, labels []Label) {
+		values[key] = value
+	}), Options{AggregateArrays: true}, log.NewNopLogger())
+
+	expected := map[string]float64{
+		"x::array_0_count": 3,
+		"x::array_0_sum":   9,
+		"x::array_0_min":   1,
+		"x::array_0_max":   6,
+		"x::array_0_avg":   3,
+		"y::array_0":       1,
+		"y::array_0::z":    2,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Got: %v, expected: %v", values, expected)
+	}
+}
+
+func TestWalkPathAggregate(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"latencies": [10, 30], "sizes": [1, 2], "x": [5]}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	opts := Options{Aggregate: []AggregateRule{{Functions: []string{"sum", "max"}}, {}}}
+	opts.Aggregate[0].Path.Set("^latencies$")
+	opts.Aggregate[1].Path.Set("^sizes$")
+
+	values := map[string]float64{}
+	WalkPath("", jsonData, nil, ReceiverFunc(func(key string, value float64, labels []Label) {
+		values[key] = value
+	}), opts, log.NewNopLogger())
+
+	expected := map[string]float64{
+		"latencies::array_0_sum": 40,
+		"latencies::array_0_max": 30,
+		"sizes::array_0_count":   2,
+		"sizes::array_0_sum":     3,
+		"sizes::array_0_min":     1,
+		"sizes::array_0_max":     2,
+		"sizes::array_0_avg":     1.5,
+		"x::array_0":             5,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Got: %v, expected: %v", values, expected)
+	}
+}
+
+func TestWalkPathFlattenSingletons(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"result": [{"value": 5, "items": [1, 2]}], "nested": [[3]], "e": []}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	testData := []struct {
+		name     string
+		opts     Options
+		expected []string
+	}{
+		{
+			name: "index labels",
+			expected: []string{
+				"nested::array_0::array_1{array_0_index=0,array_1_index=0} 3",
+				"result::array_0::items::array_1{array_0_index=0,array_1_index=0} 1",
+				"result::array_0::items::array_1{array_0_index=0,array_1_index=1} 2",
+				"result::array_0::value{array_0_index=0} 5",
+			},
+		},
+		{
+			name: "flattened",
+			opts: Options{FlattenSingletons: true},
+			expected: []string{
+				"nested{} 3",
+				"result::items::array_0{array_0_index=0} 1",
+				"result::items::array_0{array_0_index=1} 2",
+				"result::value{} 5",
+			},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var actual []string
+			WalkPath("", jsonData, nil, ReceiverFunc(func(key string, value float64, labels []Label) {
+				pairs := make([]string, len(labels))
+				for i, label := range labels {
+					pairs[i] = label.Name + "=" + label.Value
+				}
+				actual = append(actual, fmt.Sprintf("%s{%s} %v", key, strings.Join(pairs, ","), value))
+			}), tt.opts, log.NewNopLogger())
+
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkPathFlattenDepth(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"disks": {"sda": {"used": 10, "errors": [1]}}, "up": 1}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	testData := []struct {
+		name     string
+		opts     Options
+		expected []string
+	}{
+		{
+			name: "no limit",
+			expected: []string{
+				"disks::sda::errors::array_0{array_0_index=0} 1",
+				"disks::sda::used{} 10",
+				"up{} 1",
+			},
+		},
+		{
+			name: "depth 1",
+			opts: Options{FlattenDepth: 1},
+			expected: []string{
+				"disks{level_2=sda,level_3=errors,array_0_index=0} 1",
+				"disks{level_2=sda,level_3=used} 10",
+				"up{} 1",
+			},
+		},
+		{
+			name: "depth 2",
+			opts: Options{FlattenDepth: 2},
+			expected: []string{
+				"disks::sda{level_3=errors,array_0_index=0} 1",
+				"disks::sda{level_3=used} 10",
+				"up{} 1",
+			},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var actual []string
+			WalkPath("", jsonData, nil, ReceiverFunc(func(key string, value float64, labels []Label) {
+				pairs := make([]string, len(labels))
+				for i, label := range labels {
+					pairs[i] = label.Name + "=" + label.Value
+				}
+				actual = append(actual, fmt.Sprintf("%s{%s} %v", key, strings.Join(pairs, ","), value))
+			}), tt.opts, log.NewNopLogger())
+
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkPathPathIndexLabels(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"x": [[1]], "y": {"z-a": [{"w": [2]}]}, "v": [3]}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	testData := []struct {
+		name     string
+		opts     Options
+		expected []string
+	}{
+		{
+			name: "positional labels",
+			expected: []string{
+				"v::array_0 array_0_index",
+				"x::array_0::array_1 array_0_index,array_1_index",
+				"y::z_a::array_0::w::array_1 array_0_index,array_1_index",
+			},
+		},
+		{
+			name: "path labels",
+			opts: Options{PathIndexLabels: true},
+			expected: []string{
+				"v::array_0 v_array_0_index",
+				"x::array_0::array_1 x_array_0_index,x__array_0_array_1_index",
+				"y::z_a::array_0::w::array_1 y__z_a_array_0_index,y__z_a__array_0__w_array_1_index",
+			},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var actual []string
+			WalkPath("", jsonData, nil, ReceiverFunc(func(key string, value float64, labels []Label) {
+				names := make([]string, len(labels))
+				for i, label := range labels {
+					names[i] = label.Name
+				}
+				actual = append(actual, key+" "+strings.Join(names, ","))
+			}), tt.opts, log.NewNopLogger())
+
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkPathExportStrings(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"build": {"version": "1.2.3", "uptime": 42}, "state": ["up", "21"], "ok": true, "note": "", "owner": "  ", "team": " db "}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	testData := []struct {
+		name     string
+		opts     Options
+		expected []string
+	}{
+		{
+			name: "strings ignored",
+			expected: []string{
+				"build::uptime{} 42",
+				"ok{} 1",
+			},
+		},
+		{
+			name: "strings exported",
+			opts: Options{ExportStrings: true},
+			expected: []string{
+				"build::uptime{} 42",
+				"build::version{version=1.2.3} 1",
+				"ok{} 1",
+				"owner{owner=  } 1",
+				"state::array_0{array_0_index=0,state=up} 1",
+				"state::array_0{array_0_index=1,state=21} 1",
+				"team{team= db } 1",
+			},
+		},
+		{
+			name: "blank strings skipped",
+			opts: Options{ExportStrings: true, SkipBlankStrings: true},
+			expected: []string{
+				"build::uptime{} 42",
+				"build::version{version=1.2.3} 1",
+				"ok{} 1",
+				"state::array_0{array_0_index=0,state=up} 1",
+				"state::array_0{array_0_index=1,state=21} 1",
+				"team{team= db } 1",
+			},
+		},
+		{
+			name: "strings trimmed",
+			opts: Options{ExportStrings: true, TrimStrings: true},
+			expected: []string{
+				"build::uptime{} 42",
+				"build::version{version=1.2.3} 1",
+				"ok{} 1",
+				"state::array_0{array_0_index=0,state=up} 1",
+				"state::array_0{array_0_index=1,state=21} 1",
+				"team{team=db} 1",
+			},
+		},
+		{
+			name: "numeric strings parsed first",
+			opts: Options{ExportStrings: true, ParseNumericStrings: true, Separator: "_"},
+			expected: []string{
+				"build_uptime{} 42",
+				"build_version{version=1.2.3} 1",
+				"ok{} 1",
+				"owner{owner=  } 1",
+				"state_array_0{array_0_index=0,state=up} 1",
+				"state_array_0{array_0_index=1} 21",
+				"team{team= db } 1",
+			},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var actual []string
+			WalkPath("", jsonData, nil, ReceiverFunc(func(key string, value float64, labels []Label) {
+				pairs := make([]string, len(labels))
+				for i, label := range labels {
+					pairs[i] = label.Name + "=" + label.Value
+				}
+				actual = append(actual, fmt.Sprintf("%s{%s} %v", key, strings.Join(pairs, ","), value))
+			}), tt.opts, log.NewNopLogger())
+
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkPathParseBoolStrings(t *testing.T) {
+	testData := []struct {
+		name     string
+		json     string
+		opts     Options
+		expected []string
+	}{
+		{
+			name:     "strings ignored",
+			json:     `{"a": "true", "b": "false"}`,
+			expected: nil,
+		},
+		{
+			name:     "true and false",
+			json:     `{"a": "true", "b": "false"}`,
+			opts:     Options{ParseBoolStrings: true},
+			expected: []string{"a 1", "b 0"},
+		},
+		{
+			name:     "yes and no",
+			json:     `{"a": "yes", "b": "no"}`,
+			opts:     Options{ParseBoolStrings: true},
+			expected: []string{"a 1", "b 0"},
+		},
+		{
+			name:     "on and off",
+			json:     `{"a": "on", "b": "off"}`,
+			opts:     Options{ParseBoolStrings: true},
+			expected: []string{"a 1", "b 0"},
+		},
+		{
+			name:     "up and down",
+			json:     `{"a": "up", "b": "down"}`,
+			opts:     Options{ParseBoolStrings: true},
+			expected: []string{"a 1", "b 0"},
+		},
+		{
+			name:     "case and spaces ignored",
+			json:     `{"a": " TRUE ", "b": "Off"}`,
+			opts:     Options{ParseBoolStrings: true},
+			expected: []string{"a 1", "b 0"},
+		},
+		{
+			name:     "other strings ignored",
+			json:     `{"a": "maybe", "b": "1"}`,
+			opts:     Options{ParseBoolStrings: true},
+			expected: nil,
+		},
+		{
+			name:     "custom mapping",
+			json:     `{"a": "enabled", "b": "Disabled", "c": "true"}`,
+			opts:     Options{ParseBoolStrings: true, BoolStrings: map[string]bool{"enabled": true, "disabled": false}},
+			expected: []string{"a 1", "b 0"},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var jsonData interface{}
+			if err := json.Unmarshal([]byte(tt.json), &jsonData); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+
+			var actual []string
+			WalkPath("", jsonData, nil, ReceiverFunc(func(key string, value float64, labels []Label) {
+				actual = append(actual, fmt.Sprintf("%s %v", key, value))
+			}), tt.opts, log.NewNopLogger())
+			sort.Strings(actual)
+
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkPathNumericStringPath(t *testing.T) {
+	var jsonData interface{}
+	if err := json.Unmarshal([]byte(`{"uptime": "12345", "load": " 0.73", "version": "2", "name": "web"}`), &jsonData); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	opts := Options{}
+	opts.NumericStringPath.Set("^(uptime|load|name)$")
+
+	var actual []string
+	WalkPath("", jsonData, nil, ReceiverFunc(func(key string, value float64, labels []Label) {
+		actual = append(actual, fmt.Sprintf("%s %v", key, value))
+	}), opts, log.NewNopLogger())
+	sort.Strings(actual)
+
+	expected := []string{"load 0.73", "uptime 12345"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got: %v, expected: %v", actual, expected)
+	}
+}
+
+func TestWalkPathValueMaps(t *testing.T) {
+	var jsonData interface{}
+	if err := json.Unmarshal([]byte(`{"status": "Yellow", "nodes": [{"state": "red"}, {"state": "unknown"}], "color": "green"}`), &jsonData); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	health := map[string]float64{"green": 0, "yellow": 1, "red": 2}
+	opts := Options{ValueMaps: []ValueMapRule{{Values: health}, {Values: map[string]float64{"green": 5}}}}
+	opts.ValueMaps[0].Path.Set("^(status|nodes::array_0::state)$")
+	opts.ValueMaps[1].Path.Set("^(status|color)$")
+
+	var actual []string
+	WalkPath("", jsonData, nil, ReceiverFunc(func(key string, value float64, labels []Label) {
+		actual = append(actual, fmt.Sprintf("%s %v", key, value))
+	}), opts, log.NewNopLogger())
+	sort.Strings(actual)
+
+	expected := []string{"color 5", "nodes::array_0::state 2", "status 1"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Got: %v, expected: %v", actual, expected)
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	testData := []struct {
+		input    string
+		expected string
+	}{
+		{input: "x::y", expected: "x::y"},
+		{input: "cpu-usage.avg", expected: "cpu_usage_avg"},
+		{input: "2xx_count", expected: "_2xx_count"},
+		{input: "with space", expected: "with_space"},
+		{input: "caf\u00e9", expected: "caf_"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.input, func(t *testing.T) {
+			actual := SanitizeName(tt.input)
+			if actual != tt.expected {
+				t.Errorf("Got: %q, expected: %q", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkPathMaxArrayLength(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"x": [[1, 2, 3], [4]], "y": [5, 6, 7]}`), &jsonData)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	var keys []string
+	stats := WalkPath("", jsonData, nil, ReceiverFunc(func(key string, value float64, labels []Label) {
+		keys = append(keys, key)
+	}), Options{MaxArrayLength: 2}, log.NewNopLogger())
+
+	sort.Strings(keys)
+	expected := []string{"x::array_0::array_1", "x::array_0::array_1", "x::array_0::array_1", "y::array_0", "y::array_0"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Got: %v, expected: %v", keys, expected)
+	}
+	if stats.TruncatedArrays != 2 {
+		t.Errorf("Got: %d truncated arrays, expected: 2", stats.TruncatedArrays)
+	}
+}
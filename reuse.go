@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reuseVecs keeps the metric vectors of each target's walk between probes,
+// resetting them rather than building them anew, see -reuse-metric-vecs.
+var reuseVecs bool
+
+var (
+	// keptVecsIdleTimeout drops the vectors of targets not probed for this
+	// long, and maxKeptVecs bounds how many targets vectors are kept for,
+	// as every distinct target of probe requests adds some. Zero means no
+	// limit.
+	keptVecsIdleTimeout = time.Hour
+	maxKeptVecs         = 1000
+)
+
+var (
+	keptVecsMu sync.Mutex
+	keptVecs   = map[string]*walkVecs{}
+)
+
+// walkVecs holds the metric vectors a walk exports its values with, by
+// type, name, help and label names.
+type walkVecs struct {
+	inUse int32
+	// lastUsed is when the vectors were last acquired, guarded by
+	// keptVecsMu.
+	lastUsed      time.Time
+	counterVecs   map[string]*prometheus.CounterVec
+	gaugeVecs     map[string]*prometheus.GaugeVec
+	untypedVecs   map[string]*untypedVec
+	histogramVecs map[string]*prometheus.HistogramVec
+	used          map[string]bool
+}
+
+func newWalkVecs() *walkVecs {
+	return &walkVecs{
+		counterVecs:   map[string]*prometheus.CounterVec{},
+		gaugeVecs:     map[string]*prometheus.GaugeVec{},
+		untypedVecs:   map[string]*untypedVec{},
+		histogramVecs: map[string]*prometheus.HistogramVec{},
+		used:          map[string]bool{},
+	}
+}
+
+// acquireWalkVecs returns the vectors kept for probes of target with the
+// named module, and a function to call once the probe's metrics are
+// gathered, as they must not change before. It returns nil vectors when
+// reuseVecs is not set or another probe of the target is using them.
+func acquireWalkVecs(target, module string) (*walkVecs, func()) {
+	if !reuseVecs {
+		return nil, func() {}
+	}
+	now := time.Now()
+	keptVecsMu.Lock()
+	key := module + "\x00" + target
+	vecs, ok := keptVecs[key]
+	if !ok {
+		evictKeptVecs(now)
+		vecs = newWalkVecs()
+		keptVecs[key] = vecs
+	}
+	vecs.lastUsed = now
+	keptVecsMu.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&vecs.inUse, 0, 1) {
+		return nil, func() {}
+	}
+	return vecs, func() { atomic.StoreInt32(&vecs.inUse, 0) }
+}
+
+// evictKeptVecs drops the vectors idle for keptVecsIdleTimeout at now, and
+// those idle the longest if maxKeptVecs are still kept. Probes using them
+// carry on with their own reference. keptVecsMu must be held.
+func evictKeptVecs(now time.Time) {
+	for key, vecs := range keptVecs {
+		if keptVecsIdleTimeout > 0 && now.Sub(vecs.lastUsed) > keptVecsIdleTimeout {
+			delete(keptVecs, key)
+		}
+	}
+	for maxKeptVecs > 0 && len(keptVecs) >= maxKeptVecs {
+		var oldest string
+		for key, vecs := range keptVecs {
+			if oldest == "" || vecs.lastUsed.Before(keptVecs[oldest].lastUsed) {
+				oldest = key
+			}
+		}
+		delete(keptVecs, oldest)
+	}
+}
+
+// reset prepares the vectors for a new walk, dropping the series of the
+// previous one and the vectors it did not use.
+func (v *walkVecs) reset() {
+	for key, c := range v.counterVecs {
+		if !v.used[key] {
+			delete(v.counterVecs, key)
+			continue
+		}
+		c.Reset()
+	}
+	for key, g := range v.gaugeVecs {
+		if !v.used[key] {
+			delete(v.gaugeVecs, key)
+			continue
+		}
+		g.Reset()
+	}
+	for key, u := range v.untypedVecs {
+		if !v.used[key] {
+			delete(v.untypedVecs, key)
+			continue
+		}
+		u.Reset()
+	}
+	for key, h := range v.histogramVecs {
+		if !v.used[key] {
+			delete(v.histogramVecs, key)
+			continue
+		}
+		h.Reset()
+	}
+	v.used = map[string]bool{}
+}
+
+func (v *walkVecs) counterVec(name, help string, labelNames []string) *prometheus.CounterVec {
+	key := vecKey("counter", name, help, labelNames)
+	v.used[key] = true
+	c, ok := v.counterVecs[key]
+	if !ok {
+		c = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labelNames)
+		v.counterVecs[key] = c
+	}
+	return c
+}
+
+func (v *walkVecs) gaugeVec(name, help string, labelNames []string) *prometheus.GaugeVec {
+	key := vecKey("gauge", name, help, labelNames)
+	v.used[key] = true
+	g, ok := v.gaugeVecs[key]
+	if !ok {
+		g = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labelNames)
+		v.gaugeVecs[key] = g
+	}
+	return g
+}
+
+func (v *walkVecs) untypedVec(name, help string, labelNames []string) *untypedVec {
+	key := vecKey("untyped", name, help, labelNames)
+	v.used[key] = true
+	u, ok := v.untypedVecs[key]
+	if !ok {
+		u = newUntypedVec(name, help, labelNames)
+		v.untypedVecs[key] = u
+	}
+	return u
+}
+
+// histogramVec returns a vector of histograms counting their observations
+// into buckets, which must be increasing.
+func (v *walkVecs) histogramVec(name, help string, buckets []float64, labelNames []string) *prometheus.HistogramVec {
+	key := vecKey("histogram", name, help, labelNames) + "\xff" + fmt.Sprint(buckets)
+	v.used[key] = true
+	h, ok := v.histogramVecs[key]
+	if !ok {
+		h = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labelNames)
+		v.histogramVecs[key] = h
+	}
+	return h
+}
+
+func vecKey(metricType, name, help string, labelNames []string) string {
+	return metricType + "\xff" + name + "\xff" + help + "\xff" + strings.Join(labelNames, "\xff")
+}
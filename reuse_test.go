@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/shiroyagicorp/prometheus-json-exporter/pkg/jsonwalk"
+)
+
+func TestProbeHandlerReuseVecs(t *testing.T) {
+	defer func(reuse bool) { reuseVecs = reuse }(reuseVecs)
+	reuseVecs = true
+
+	documents := []string{`{"x": 1, "y": [1, 2]}`, `{"x": 2, "y": [3]}`}
+	scrape := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(documents[scrape]))
+	}))
+	defer server.Close()
+
+	testData := []struct {
+		expected   []string
+		unexpected []string
+	}{
+		{
+			expected: []string{"x 1\n", `y::array_0{array_0_index="0"} 1`, `y::array_0{array_0_index="1"} 2`},
+		},
+		{
+			expected:   []string{"x 2\n", `y::array_0{array_0_index="0"} 3`},
+			unexpected: []string{"x 1\n", `array_0_index="1"`},
+		},
+	}
+
+	for i, tt := range testData {
+		scrape = i
+		req := httptest.NewRequest("GET", "/probe?target="+server.URL, nil)
+		rec := httptest.NewRecorder()
+		probeHandler(rec, req, log.NewNopLogger())
+
+		body := rec.Body.String()
+		for _, expected := range tt.expected {
+			if !strings.Contains(body, expected) {
+				t.Errorf("Got: %s, expected to contain: %s", body, expected)
+			}
+		}
+		for _, unexpected := range tt.unexpected {
+			if strings.Contains(body, unexpected) {
+				t.Errorf("Got: %s, expected not to contain: %s", body, unexpected)
+			}
+		}
+	}
+}
+
+func TestAcquireWalkVecs(t *testing.T) {
+	defer func(reuse bool) { reuseVecs = reuse }(reuseVecs)
+
+	reuseVecs = false
+	if vecs, release := acquireWalkVecs("http://a", ""); vecs != nil {
+		t.Errorf("Got: %v, expected no vectors without reuse", vecs)
+	} else {
+		release()
+	}
+
+	reuseVecs = true
+	vecs, release := acquireWalkVecs("http://a", "")
+	if vecs == nil {
+		t.Fatalf("Got no vectors, expected kept ones")
+	}
+	if other, _ := acquireWalkVecs("http://a", ""); other != nil {
+		t.Errorf("Got: %v, expected no vectors while in use", other)
+	}
+	release()
+	again, release := acquireWalkVecs("http://a", "")
+	defer release()
+	if again != vecs {
+		t.Errorf("Got: %p, expected the kept vectors %p", again, vecs)
+	}
+}
+
+func TestAcquireWalkVecsEvicts(t *testing.T) {
+	defer func(reuse bool, idle time.Duration, max int) {
+		reuseVecs, keptVecsIdleTimeout, maxKeptVecs = reuse, idle, max
+	}(reuseVecs, keptVecsIdleTimeout, maxKeptVecs)
+	defer func() { keptVecs = map[string]*walkVecs{} }()
+	keptVecs = map[string]*walkVecs{}
+	reuseVecs = true
+	maxKeptVecs = 2
+
+	for _, target := range []string{"http://a", "http://b", "http://c"} {
+		_, release := acquireWalkVecs(target, "")
+		release()
+	}
+	if len(keptVecs) != 2 {
+		t.Errorf("Got: %d kept vectors, expected: 2", len(keptVecs))
+	}
+	if _, ok := keptVecs["\x00http://a"]; ok {
+		t.Errorf("Got: vectors of http://a, expected them to be dropped first")
+	}
+
+	keptVecs = map[string]*walkVecs{}
+	keptVecsIdleTimeout = 50 * time.Millisecond
+	maxKeptVecs = 0
+	_, release := acquireWalkVecs("http://d", "")
+	release()
+	time.Sleep(100 * time.Millisecond)
+	_, release = acquireWalkVecs("http://e", "")
+	release()
+	if len(keptVecs) != 1 {
+		t.Errorf("Got: %d kept vectors, expected only those of the recent target", len(keptVecs))
+	}
+}
+
+func BenchmarkWalkJSON(b *testing.B) {
+	var items []string
+	for i := 0; i < 1000; i++ {
+		items = append(items, fmt.Sprintf(`{"id": %d, "cpu": %d.5, "memory": %d, "disk": {"read": %d, "write": %d}}`, i, i, i*1024, i*2, i*3))
+	}
+	var jsonData interface{}
+	if err := json.Unmarshal([]byte(`{"nodes": [`+strings.Join(items, ",")+`]}`), &jsonData); err != nil {
+		b.Fatalf("Error: %v", err)
+	}
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			doWalkJSON("", jsonData, prometheus.NewRegistry(), jsonwalk.Options{}, log.NewNopLogger())
+		}
+	})
+	b.Run("reused", func(b *testing.B) {
+		b.ReportAllocs()
+		vecs := newWalkVecs()
+		for i := 0; i < b.N; i++ {
+			vecs.walkJSON("", jsonData, prometheus.NewRegistry(), jsonwalk.Options{}, log.NewNopLogger())
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// defaultScrapeInterval is how often scrape targets are probed when they
+// set no interval.
+const defaultScrapeInterval = time.Minute
+
+// scrapeStaleIntervals is how many intervals the metrics of a scrape target
+// are served for after its last probe, so that a target whose probes hang
+// disappears rather than reporting old values.
+const scrapeStaleIntervals = 3
+
+// ScrapeTarget is a target probed in the background, whose metrics are
+// served on the telemetry path, for setups that cannot pass targets to
+// /probe.
+type ScrapeTarget struct {
+	Target string `yaml:"target"`
+	// Module names the module to probe the target with. Empty means the
+	// settings given by flags.
+	Module string `yaml:"module"`
+	// Interval is how often the target is probed. Zero means
+	// defaultScrapeInterval.
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (t ScrapeTarget) interval() time.Duration {
+	if t.Interval == 0 {
+		return defaultScrapeInterval
+	}
+	return t.Interval
+}
+
+func (t ScrapeTarget) validate(modules map[string]Module) error {
+	if t.Target == "" {
+		return fmt.Errorf("missing target")
+	}
+	if t.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	module := defaultModule
+	if t.Module != "" {
+		var ok bool
+		if module, ok = modules[t.Module]; !ok {
+			return fmt.Errorf("unknown module %q", t.Module)
+		}
+	}
+	if _, ok := module.Labels["target"]; ok {
+		return fmt.Errorf(`label "target" of module %q clashes with the label of scrape targets`, t.Module)
+	}
+	if _, ok := module.LabelPaths["target"]; ok {
+		return fmt.Errorf(`label "target" of module %q clashes with the label of scrape targets`, t.Module)
+	}
+	return nil
+}
+
+// scrapes probes the scrape targets of the configuration.
+var scrapes = &scraper{results: map[int]scrapeResult{}}
+
+// scraper probes targets in the background and serves the metrics of their
+// last probes as a prometheus.Gatherer.
+type scraper struct {
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	results map[int]scrapeResult
+}
+
+type scrapeResult struct {
+	families []*dto.MetricFamily
+	expires  time.Time
+}
+
+// update stops probing the previous targets, forgetting their metrics, and
+// starts probing targets.
+func (s *scraper) update(targets []ScrapeTarget, logger log.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.results = map[int]scrapeResult{}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	for i, target := range targets {
+		go s.run(ctx, i, target, log.With(logger, "target", target.Target))
+	}
+}
+
+// run probes target every interval until ctx is canceled.
+func (s *scraper) run(ctx context.Context, i int, target ScrapeTarget, logger log.Logger) {
+	ticker := time.NewTicker(target.interval())
+	defer ticker.Stop()
+	for {
+		s.scrape(ctx, i, target, logger)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrape probes target once and keeps its metrics, labeled with the target
+// like those of a probe of several targets.
+func (s *scraper) scrape(ctx context.Context, i int, target ScrapeTarget, logger log.Logger) {
+	module := defaultModule
+	if target.Module != "" {
+		module = currentConfig().Modules[target.Module]
+	}
+	registry := prometheus.NewRegistry()
+	targetRegistry := prometheus.WrapRegistererWith(prometheus.Labels{"target": target.Target}, registry)
+	runProbe(ctx, targetRegistry, target.Target, module, nil, logger)
+	families, err := registry.Gather()
+	if err != nil {
+		level.Error(logger).Log("msg", "Error gathering metrics of scrape target", "err", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	s.results[i] = scrapeResult{families: families, expires: time.Now().Add(scrapeStaleIntervals * target.interval())}
+}
+
+// Gather returns the metrics of the targets that are not stale, implementing
+// prometheus.Gatherer.
+func (s *scraper) Gather() ([]*dto.MetricFamily, error) {
+	s.mu.Lock()
+	var gatherers prometheus.Gatherers
+	now := time.Now()
+	for _, result := range s.results {
+		if now.Before(result.expires) {
+			families := result.families
+			gatherers = append(gatherers, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				return families, nil
+			}))
+		}
+	}
+	s.mu.Unlock()
+	return gatherers.Gather()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScraper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	defer func(c *Config) { config = c }(config)
+	config = &Config{Modules: map[string]Module{"app": {Prefix: "app"}}}
+
+	s := &scraper{results: map[int]scrapeResult{}}
+	s.update([]ScrapeTarget{{Target: server.URL, Module: "app", Interval: time.Hour}}, log.NewNopLogger())
+	defer s.update(nil, log.NewNopLogger())
+
+	expected := `# HELP app::x Retrieved value
+# TYPE app::x gauge
+app::x{target="` + server.URL + `"} 1
+`
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := testutil.GatherAndCompare(s, strings.NewReader(expected), "app::x")
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Error: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stale results are not served.
+	s.mu.Lock()
+	for i, result := range s.results {
+		result.expires = time.Now()
+		s.results[i] = result
+	}
+	s.mu.Unlock()
+	if families, err := s.Gather(); err != nil || len(families) != 0 {
+		t.Errorf("Got: %v, %v, expected no metrics", families, err)
+	}
+
+	s.update(nil, log.NewNopLogger())
+	if families, err := s.Gather(); err != nil || len(families) != 0 {
+		t.Errorf("Got: %v, %v, expected no metrics", families, err)
+	}
+}
+
+func TestServeMuxScrapeTargets(t *testing.T) {
+	defer func(s *scraper) { scrapes = s }(scrapes)
+	scrapes = &scraper{results: map[int]scrapeResult{}}
+	scrapes.update([]ScrapeTarget{{Target: "file:///nonexistent.json", Interval: time.Hour}}, log.NewNopLogger())
+	defer scrapes.update(nil, log.NewNopLogger())
+
+	mux := newServeMux("/probe", "/metrics", func() error { return nil }, log.NewNopLogger())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body := rec.Body.String()
+		if strings.Contains(body, `probe_success{target="file:///nonexistent.json"} 0`) && strings.Contains(body, "json_exporter_build_info") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Got: %s, expected the metrics of the scrape target", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
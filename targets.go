@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/shiroyagicorp/prometheus-json-exporter/pkg/jsonwalk"
+)
+
+var (
+	// allowedTargets is matched against the target of each probe, and
+	// probes of targets it does not match are refused. Unset allows any
+	// target.
+	allowedTargets jsonwalk.Regexp
+	// allowedNetworks are the only networks targets may be requested
+	// from when set. Their addresses are allowed even when
+	// blockPrivateNetworks is set.
+	allowedNetworks []*net.IPNet
+	// blockPrivateNetworks refuses requests to loopback, private and
+	// link-local addresses, such as cloud metadata services.
+	blockPrivateNetworks bool
+	// allowedFileDirs are the only directories file:// targets may be
+	// read from when set, along with their subdirectories.
+	allowedFileDirs []string
+	// allowUnixTargets allows unix:// targets, which reach local services
+	// such as the Docker daemon that are not meant to be exposed.
+	allowUnixTargets bool
+)
+
+// privateNetworks are the networks refused by blockPrivateNetworks, besides
+// loopback, link-local and unspecified addresses.
+var privateNetworks = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// parseCIDRs parses networks in CIDR notation, e.g. 10.0.0.0/8.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// checkTarget returns an error if probes of target are not allowed by
+// allowedTargets and allowUnixTargets. File targets are only allowed once
+// allowedFileDirs restricts them.
+func checkTarget(target string) error {
+	if strings.HasPrefix(target, "file://") && len(allowedFileDirs) == 0 {
+		return fmt.Errorf("file targets are not allowed")
+	}
+	if strings.HasPrefix(target, "unix://") && !allowUnixTargets {
+		return fmt.Errorf("unix targets are not allowed")
+	}
+	if allowedTargets.Regexp != nil && !allowedTargets.MatchString(target) {
+		return fmt.Errorf("target %q is not allowed", target)
+	}
+	return nil
+}
+
+// checkIP returns an error if requests to ip are not allowed by
+// allowedNetworks and blockPrivateNetworks.
+func checkIP(ip net.IP) error {
+	for _, network := range allowedNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	if len(allowedNetworks) > 0 {
+		return fmt.Errorf("address %s is not in an allowed network", ip)
+	}
+	if !blockPrivateNetworks {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("address %s is in a private network", ip)
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return fmt.Errorf("address %s is in a private network", ip)
+		}
+	}
+	return nil
+}
+
+// parseFileDirs checks that dirs, the directories of -allowed-file-dirs,
+// are absolute, and cleans them.
+func parseFileDirs(dirs []string) ([]string, error) {
+	cleaned := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("directory %q is not absolute", dir)
+		}
+		cleaned = append(cleaned, filepath.Clean(dir))
+	}
+	return cleaned, nil
+}
+
+// checkFile returns the path to read the file at path from, or an error if
+// reading it is not allowed by allowedFileDirs. Symbolic links are followed
+// first, so that links cannot lead out of the allowed directories, and the
+// resolved path is returned so that the file checked is the one read.
+func checkFile(path string) (string, error) {
+	if len(allowedFileDirs) == 0 {
+		return path, nil
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range allowedFileDirs {
+		if resolvedDir, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = resolvedDir
+		}
+		rel, err := filepath.Rel(dir, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("file %s is not in an allowed directory", path)
+}
+
+// checkDial is a net.Dialer Control function applying checkIP to the
+// address being connected to, once its name is resolved, so that names
+// resolving to refused addresses are refused too.
+func checkDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid address %q", address)
+	}
+	return checkIP(ip)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+
+	"github.com/shiroyagicorp/prometheus-json-exporter/pkg/jsonwalk"
+)
+
+func TestCheckIP(t *testing.T) {
+	defer func(n []*net.IPNet, b bool) { allowedNetworks, blockPrivateNetworks = n, b }(allowedNetworks, blockPrivateNetworks)
+
+	testData := []struct {
+		name     string
+		allowed  []string
+		block    bool
+		ip       string
+		expected bool
+	}{
+		{name: "no restrictions", ip: "127.0.0.1", expected: true},
+		{name: "public", block: true, ip: "8.8.8.8", expected: true},
+		{name: "loopback", block: true, ip: "127.0.0.1"},
+		{name: "ipv6 loopback", block: true, ip: "::1"},
+		{name: "private", block: true, ip: "192.168.1.10"},
+		{name: "metadata service", block: true, ip: "169.254.169.254"},
+		{name: "unique local", block: true, ip: "fd00::1"},
+		{name: "allowed private", allowed: []string{"10.1.0.0/16"}, block: true, ip: "10.1.2.3", expected: true},
+		{name: "outside allowed", allowed: []string{"10.1.0.0/16"}, ip: "10.2.0.1"},
+		{name: "public outside allowed", allowed: []string{"10.1.0.0/16"}, ip: "8.8.8.8"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			allowedNetworks = mustParseCIDRs(tt.allowed...)
+			blockPrivateNetworks = tt.block
+			if err := checkIP(net.ParseIP(tt.ip)); (err == nil) != tt.expected {
+				t.Errorf("Got: %v, expected allowed: %v", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	defer func(dirs []string) { allowedFileDirs = dirs }(allowedFileDirs)
+
+	root := t.TempDir()
+	allowed := filepath.Join(root, "allowed")
+	for _, dir := range []string{allowed, filepath.Join(allowed, "sub"), filepath.Join(root, "other")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	for _, path := range []string{filepath.Join(allowed, "sub", "stats.json"), filepath.Join(root, "other", "secret.json")} {
+		if err := ioutil.WriteFile(path, []byte(`{}`), 0644); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "other", "secret.json"), filepath.Join(allowed, "link.json")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	testData := []struct {
+		name     string
+		dirs     []string
+		path     string
+		expected bool
+	}{
+		{name: "no restrictions", path: filepath.Join(root, "other", "secret.json"), expected: true},
+		{name: "in subdirectory", dirs: []string{allowed}, path: filepath.Join(allowed, "sub", "stats.json"), expected: true},
+		{name: "outside", dirs: []string{allowed}, path: filepath.Join(root, "other", "secret.json")},
+		{name: "dot dot", dirs: []string{allowed}, path: allowed + "/../other/secret.json"},
+		{name: "symlink out", dirs: []string{allowed}, path: filepath.Join(allowed, "link.json")},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			allowedFileDirs = tt.dirs
+			path, err := checkFile(tt.path)
+			if (err == nil) != tt.expected {
+				t.Errorf("Got: %v, expected allowed: %v", err, tt.expected)
+			}
+			if resolved, _ := filepath.EvalSymlinks(tt.path); err == nil && path != resolved {
+				t.Errorf("Got: %s, expected the resolved path: %s", path, resolved)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerAllowedTargets(t *testing.T) {
+	defer func(re jsonwalk.Regexp) { allowedTargets = re }(allowedTargets)
+	allowedTargets.Set(`^https://[^/]*\.example\.com/`)
+
+	for _, target := range []string{"http://169.254.169.254/latest/meta-data/", "file:///etc/passwd", "https://evil.com/?.example.com/"} {
+		rec := httptest.NewRecorder()
+		probeHandler(rec, httptest.NewRequest("GET", "/probe?target="+target, nil), log.NewNopLogger())
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("Got status: %d for %s, expected: %d", rec.Code, target, http.StatusForbidden)
+		}
+	}
+}
+
+func TestProbeHandlerFileTargets(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stats.json")
+	if err := ioutil.WriteFile(path, []byte(`{"x": 1}`), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", "/probe?target=file://"+path, nil), log.NewNopLogger())
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusForbidden)
+	}
+
+	defer func(dirs []string) { allowedFileDirs = dirs }(allowedFileDirs)
+	allowedFileDirs = []string{dir}
+	rec = httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", "/probe?target=file://"+path, nil), log.NewNopLogger())
+	if body := rec.Body.String(); !strings.Contains(body, "\nx 1\n") {
+		t.Errorf("Got: %s, expected to contain: x 1", body)
+	}
+}
+
+func TestProbeHandlerAllowedTargetsRedirect(t *testing.T) {
+	disallowed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"secret": 42}`))
+	}))
+	defer disallowed.Close()
+	allowed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, disallowed.URL, http.StatusFound)
+	}))
+	defer allowed.Close()
+
+	defer func(re jsonwalk.Regexp) { allowedTargets = re }(allowedTargets)
+	allowedTargets.Set("^" + regexp.QuoteMeta(allowed.URL) + "$")
+	defer func(m Module) { defaultModule = m }(defaultModule)
+	defaultModule.Probe.FollowRedirects = true
+
+	rec := httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", "/probe?target="+allowed.URL, nil), log.NewNopLogger())
+	if body := rec.Body.String(); !strings.Contains(body, "probe_success 0") || strings.Contains(body, "secret 42") {
+		t.Errorf("Got: %s, expected a failed probe", body)
+	}
+}
+
+func TestProbeHandlerUnixTargets(t *testing.T) {
+	rec := httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", "/probe?target=unix:///var/run/docker.sock:/containers/json", nil), log.NewNopLogger())
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Got status: %d, expected: %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestProbeHandlerBlockPrivateNetworks(t *testing.T) {
+	defer func(b bool) { blockPrivateNetworks = b }(blockPrivateNetworks)
+	blockPrivateNetworks = true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	rec := httptest.NewRecorder()
+	probeHandler(rec, httptest.NewRequest("GET", "/probe?target="+server.URL, nil), log.NewNopLogger())
+	if body := rec.Body.String(); !strings.Contains(body, "probe_success 0") || strings.Contains(body, "\nx 1") {
+		t.Errorf("Got: %s, expected a failed probe", body)
+	}
+}
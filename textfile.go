@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// runTextfile probes target every interval and writes the resulting metrics
+// to output in the text exposition format, so node_exporter's textfile
+// collector can pick them up. It never returns.
+func runTextfile(target string, module Module, output string, interval time.Duration, logger log.Logger) {
+	logger = log.With(logger, "target", target)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := writeTextfile(target, module, output, logger); err != nil {
+			level.Error(logger).Log("msg", "Error writing textfile", "err", err)
+		}
+		<-ticker.C
+	}
+}
+
+// writeTextfile probes target once and writes the metrics to output. The
+// file is replaced atomically, so the collector never reads a partial file.
+// A failed probe still replaces the previous file, with probe_success 0, so
+// that its values do not outlive the target, and its error is returned.
+func writeTextfile(target string, module Module, output string, logger log.Logger) error {
+	registry := prometheus.NewRegistry()
+	err := probe(context.Background(), registry, target, module, nil, logger)
+	if err := prometheus.WriteToTextfile(output, registry); err != nil {
+		return err
+	}
+	return err
+}
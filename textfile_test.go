@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": {"y": 2}}`))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "json.prom")
+	if err := writeTextfile(server.URL, Module{}, output, log.NewNopLogger()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	bytes, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, expected := range []string{"x::y 2\n", "probe_max_depth 2\n"} {
+		if !strings.Contains(string(bytes), expected) {
+			t.Errorf("Got: %s, expected to contain: %s", bytes, expected)
+		}
+	}
+}
+
+func TestWriteTextfileProbeError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`not json`))
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "json.prom")
+	if err := ioutil.WriteFile(output, []byte("x::y 2\n"), 0644); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := writeTextfile(server.URL, Module{}, output, log.NewNopLogger()); err == nil {
+		t.Errorf("Expected an error")
+	}
+
+	bytes, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !strings.Contains(string(bytes), "probe_success 0\n") || strings.Contains(string(bytes), "x::y") {
+		t.Errorf("Got: %s, expected the previous values replaced by a failed probe", bytes)
+	}
+}
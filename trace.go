@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// httpPhases lists the phases of probe_http_duration_seconds.
+var httpPhases = []string{"resolve", "connect", "tls", "processing", "transfer", "parse"}
+
+// probeTrace records when the phases of a probe's request start and end.
+// After retries, it holds the times of the last attempt.
+type probeTrace struct {
+	mu sync.Mutex
+	// retries counts the requests retried after the first one.
+	retries int
+	// redirects counts the redirects followed by the last attempt.
+	redirects int
+	// Connections may be dialed to several addresses concurrently, so
+	// the times are set under mu.
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	wroteRequest, firstByte   time.Time
+	bodyRead, parsed          time.Time
+}
+
+type probeTraceKey struct{}
+
+// withProbeTrace returns a context recording the phases of the requests
+// made with it into t.
+func withProbeTrace(ctx context.Context, t *probeTrace) context.Context {
+	ctx = context.WithValue(ctx, probeTraceKey{}, t)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.mark(&t.dnsDone) },
+		ConnectStart:         func(string, string) { t.mark(&t.connectStart) },
+		ConnectDone:          func(string, string, error) { t.mark(&t.connectDone) },
+		TLSHandshakeStart:    func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.mark(&t.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.mark(&t.firstByte) },
+	})
+}
+
+// probeTraceFrom returns the trace recorded by ctx, or a new one nothing
+// reads if there is none.
+func probeTraceFrom(ctx context.Context) *probeTrace {
+	if t, ok := ctx.Value(probeTraceKey{}).(*probeTrace); ok {
+		return t
+	}
+	return &probeTrace{}
+}
+
+// mark sets the time at field to now.
+func (t *probeTrace) mark(field *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	*field = time.Now()
+}
+
+// retried counts a retry of the request.
+func (t *probeTrace) retried() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.retries++
+}
+
+// retryCount returns the number of retries counted.
+func (t *probeTrace) retryCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.retries
+}
+
+// setRedirects sets the number of redirects followed.
+func (t *probeTrace) setRedirects(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.redirects = n
+}
+
+// redirectCount returns the number of redirects followed.
+func (t *probeTrace) redirectCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.redirects
+}
+
+// durations returns how long each of httpPhases took in seconds, 0 for
+// those that did not happen, e.g. resolving an IP address.
+func (t *probeTrace) durations() map[string]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	between := func(start, end time.Time) float64 {
+		if start.IsZero() || end.Before(start) {
+			return 0
+		}
+		return end.Sub(start).Seconds()
+	}
+	return map[string]float64{
+		"resolve":    between(t.dnsStart, t.dnsDone),
+		"connect":    between(t.connectStart, t.connectDone),
+		"tls":        between(t.tlsStart, t.tlsDone),
+		"processing": between(t.wroteRequest, t.firstByte),
+		"transfer":   between(t.firstByte, t.bodyRead),
+		"parse":      between(t.bodyRead, t.parsed),
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestProbeHTTPDuration(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	module := Module{}
+	module.Probe.TLS.InsecureSkipVerify = true
+	registry := prometheus.NewRegistry()
+	if err := probe(context.Background(), registry, server.URL, module, nil, log.NewNopLogger()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	actual := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "probe_http_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.Metric {
+			actual[metric.Label[0].GetValue()] = metric.GetGauge().GetValue()
+		}
+	}
+
+	if len(actual) != len(httpPhases) {
+		t.Errorf("Got: %v, expected the phases: %v", actual, httpPhases)
+	}
+	// The target is an IP address, so there is nothing to resolve.
+	if actual["resolve"] != 0 {
+		t.Errorf("Got resolve: %v, expected: 0", actual["resolve"])
+	}
+	for _, phase := range []string{"connect", "tls"} {
+		if actual[phase] <= 0 {
+			t.Errorf("Got %s: %v, expected more than 0", phase, actual[phase])
+		}
+	}
+	if actual["processing"] < 0.02 {
+		t.Errorf("Got processing: %v, expected at least 0.02", actual["processing"])
+	}
+}
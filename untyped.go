@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// untypedVec is a vector of untyped metrics, which client_golang only
+// provides as constant metrics.
+type untypedVec struct {
+	desc       *prometheus.Desc
+	labelNames []string
+
+	mu      sync.Mutex
+	metrics map[string]prometheus.Metric
+}
+
+func newUntypedVec(name, help string, labelNames []string) *untypedVec {
+	return &untypedVec{
+		desc:       prometheus.NewDesc(name, help, labelNames, nil),
+		labelNames: labelNames,
+		metrics:    map[string]prometheus.Metric{},
+	}
+}
+
+func (v *untypedVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+func (v *untypedVec) Collect(ch chan<- prometheus.Metric) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, metric := range v.metrics {
+		ch <- metric
+	}
+}
+
+// Set sets the value of the series with labels, which must have the label
+// names of the vector.
+func (v *untypedVec) Set(labels prometheus.Labels, value float64) error {
+	if len(labels) != len(v.labelNames) {
+		return fmt.Errorf("inconsistent label names, expected %v", v.labelNames)
+	}
+	labelValues := make([]string, len(v.labelNames))
+	for i, name := range v.labelNames {
+		labelValue, ok := labels[name]
+		if !ok {
+			return fmt.Errorf("inconsistent label names, expected %v", v.labelNames)
+		}
+		labelValues[i] = labelValue
+	}
+	metric, err := prometheus.NewConstMetric(v.desc, prometheus.UntypedValue, value, labelValues...)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.metrics[strings.Join(labelValues, "\xff")] = metric
+	return nil
+}
+
+// Reset deletes every series of the vector.
+func (v *untypedVec) Reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.metrics = map[string]prometheus.Metric{}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	stdlog "log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ready is 1 once the exporter has loaded its configuration and can serve
+// probes.
+var ready int32
+
+func setReady(r bool) {
+	var v int32
+	if r {
+		v = 1
+	}
+	atomic.StoreInt32(&ready, v)
+}
+
+// newServeMux routes the exporter's endpoints, serving probes on probePath
+// and the exporter's own metrics on telemetryPath. A POST to /-/reload calls
+// reload.
+func newServeMux(probePath, telemetryPath string, reload func() error, logger log.Logger) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, indexHTML, html.EscapeString(probePath), html.EscapeString(telemetryPath))
+	})
+	mux.HandleFunc(probePath, func(w http.ResponseWriter, r *http.Request) {
+		probeHandler(w, r, logger)
+	})
+	mux.HandleFunc("/debug/walk", func(w http.ResponseWriter, r *http.Request) {
+		debugWalkHandler(w, r, logger)
+	})
+	// The metrics of scrape targets are served with the exporter's own.
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, scrapes}
+	mux.Handle(telemetryPath, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{
+			ErrorHandling: promhttp.ContinueOnError,
+			ErrorLog:      stdlog.New(log.NewStdlibAdapter(level.Error(logger)), "", 0),
+		})))
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Healthy\n"))
+	})
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			http.Error(w, "Not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("Ready\n"))
+	})
+	mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to reload config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("Reloaded\n"))
+	})
+	return mux
+}
+
+const indexHTML = `<html>
+<head><title>Json Exporter</title></head>
+<body>
+<h1>Json Exporter</h1>
+<p><a href="%[1]s">Run a probe</a></p>
+<p><a href="/debug/walk">Show what a probe would export</a></p>
+<p><a href="%[2]s">Metrics</a></p>
+</body>
+</html>`
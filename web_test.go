@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestServeMux(t *testing.T) {
+	defer atomic.StoreInt32(&ready, atomic.LoadInt32(&ready))
+	mux := newServeMux("/json", "/internal/metrics", func() error { return nil }, log.NewNopLogger())
+
+	testData := []struct {
+		name     string
+		ready    bool
+		path     string
+		code     int
+		contains string
+	}{
+		{name: "index", path: "/", code: http.StatusOK, contains: `<a href="/json">`},
+		{name: "unknown path", path: "/nonexistent", code: http.StatusNotFound},
+		{name: "probe path", path: "/json", code: http.StatusBadRequest, contains: "Target parameter is missing"},
+		{name: "default probe path", path: "/probe", code: http.StatusNotFound},
+		{name: "telemetry path", path: "/internal/metrics", code: http.StatusOK, contains: "json_exporter_build_info"},
+		{name: "healthy", path: "/-/healthy", code: http.StatusOK},
+		{name: "not ready", path: "/-/ready", code: http.StatusServiceUnavailable},
+		{name: "ready", ready: true, path: "/-/ready", code: http.StatusOK},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			setReady(tt.ready)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != tt.code {
+				t.Errorf("Got status: %d, expected: %d", rec.Code, tt.code)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tt.contains) {
+				t.Errorf("Got: %s, expected to contain: %s", body, tt.contains)
+			}
+		})
+	}
+}
+
+func TestServeMuxReload(t *testing.T) {
+	var reloadErr error
+	reloads := 0
+	mux := newServeMux("/probe", "/metrics", func() error {
+		reloads++
+		return reloadErr
+	}, log.NewNopLogger())
+
+	testData := []struct {
+		name     string
+		method   string
+		err      error
+		code     int
+		contains string
+	}{
+		{name: "get", method: "GET", code: http.StatusMethodNotAllowed},
+		{name: "post", method: "POST", code: http.StatusOK, contains: "Reloaded"},
+		{name: "error", method: "POST", err: errors.New("invalid config"), code: http.StatusInternalServerError, contains: "Failed to reload config: invalid config"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			reloadErr = tt.err
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(tt.method, "/-/reload", nil))
+			if rec.Code != tt.code {
+				t.Errorf("Got status: %d, expected: %d", rec.Code, tt.code)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tt.contains) {
+				t.Errorf("Got: %s, expected to contain: %s", body, tt.contains)
+			}
+		})
+	}
+	if reloads != 2 {
+		t.Errorf("Got reloads: %d, expected: 2", reloads)
+	}
+}
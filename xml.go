@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+)
+
+// maxXMLDepth bounds the nesting of XML documents, like encoding/json does
+// for JSON, so that a hostile document cannot exhaust the stack.
+const maxXMLDepth = 10000
+
+// xmlTextKey holds the text of XML elements that also have attributes or
+// children.
+const xmlTextKey = "text"
+
+// jsonNumber matches the numbers of the JSON grammar.
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// isXMLContentType reports whether contentType is application/xml, text/xml
+// or a structured syntax suffix type like application/atom+xml.
+func isXMLContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// parseXML parses the XML document in data into the shape parseJSON
+// returns, so that it is walked the same way.
+// The root element becomes an object holding a single key, its name.
+// Elements become objects keyed by the names of their attributes and
+// children, repeated children become arrays, and elements holding only text
+// become its value, a json.Number when it is a number. The text of other
+// elements is kept under xmlTextKey.
+func parseXML(data []byte) (interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no XML element found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			value, err := xmlElement(decoder, start, 1)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{start.Name.Local: value}, nil
+		}
+	}
+}
+
+// xmlElement converts the element opened by start, reading up to its end.
+func xmlElement(decoder *xml.Decoder, start xml.StartElement, depth int) (interface{}, error) {
+	if depth > maxXMLDepth {
+		return nil, fmt.Errorf("XML nested deeper than %d elements", maxXMLDepth)
+	}
+
+	object := map[string]interface{}{}
+	for _, attr := range start.Attr {
+		if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+			continue
+		}
+		object[attr.Name.Local] = xmlText(attr.Value)
+	}
+
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			child, err := xmlElement(decoder, t, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			name := t.Name.Local
+			switch existing := object[name].(type) {
+			case nil:
+				object[name] = child
+			case []interface{}:
+				object[name] = append(existing, child)
+			default:
+				object[name] = []interface{}{existing, child}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			s := strings.TrimSpace(text.String())
+			if len(object) == 0 {
+				return xmlText(s), nil
+			}
+			if s != "" {
+				object[xmlTextKey] = xmlText(s)
+			}
+			return object, nil
+		}
+	}
+}
+
+// xmlText returns the value of the text of an element or attribute.
+func xmlText(s string) interface{} {
+	s = strings.TrimSpace(s)
+	if jsonNumber.MatchString(s) {
+		return json.Number(s)
+	}
+	return s
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseXML(t *testing.T) {
+	testData := []struct {
+		name     string
+		xml      string
+		expected interface{}
+		err      string
+	}{
+		{
+			name: "elements and attributes",
+			xml: `<?xml version="1.0"?>
+<status xmlns="urn:example" version="2">
+  <uptime>42</uptime>
+  <state>running</state>
+  <queue name="jobs" length="3">pending</queue>
+  <empty/>
+</status>`,
+			expected: map[string]interface{}{
+				"status": map[string]interface{}{
+					"version": json.Number("2"),
+					"uptime":  json.Number("42"),
+					"state":   "running",
+					"queue":   map[string]interface{}{"name": "jobs", "length": json.Number("3"), "text": "pending"},
+					"empty":   "",
+				},
+			},
+		},
+		{
+			name: "repeated elements",
+			xml:  `<disks><disk><used>10</used></disk><disk><used>20</used></disk><disk><used>30</used></disk></disks>`,
+			expected: map[string]interface{}{
+				"disks": map[string]interface{}{
+					"disk": []interface{}{
+						map[string]interface{}{"used": json.Number("10")},
+						map[string]interface{}{"used": json.Number("20")},
+						map[string]interface{}{"used": json.Number("30")},
+					},
+				},
+			},
+		},
+		{
+			name:     "not numbers",
+			xml:      `<x><a>0x10</a><b>1,5</b><c>-1.5e3</c></x>`,
+			expected: map[string]interface{}{"x": map[string]interface{}{"a": "0x10", "b": "1,5", "c": json.Number("-1.5e3")}},
+		},
+		{
+			name: "empty document",
+			xml:  `<?xml version="1.0"?>`,
+			err:  "no XML element found",
+		},
+		{
+			name: "unclosed element",
+			xml:  `<x><a>1</a>`,
+			err:  "unexpected EOF",
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := parseXML([]byte(tt.xml))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Got error: %v, expected: %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDoProbeXML(t *testing.T) {
+	testData := []struct {
+		name        string
+		contentType string
+		format      string
+		err         bool
+	}{
+		{name: "XML Content-Type", contentType: "application/xml; charset=utf-8"},
+		{name: "text/xml", contentType: "text/xml"},
+		{name: "format parameter", contentType: "text/plain", format: "xml"},
+		{name: "XML disabled", contentType: "application/xml", format: "json", err: true},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(`<stats><count>3</count></stats>`))
+			}))
+			defer server.Close()
+
+			jsonData, _, err := doProbe(context.Background(), server.Client(), server.URL, probeOptions{Format: tt.format})
+			if tt.err {
+				if err == nil {
+					t.Errorf("Got no error, expected one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			expected := map[string]interface{}{"stats": map[string]interface{}{"count": json.Number("3")}}
+			if !reflect.DeepEqual(jsonData, expected) {
+				t.Errorf("Got: %v, expected: %v", jsonData, expected)
+			}
+		})
+	}
+}